@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+type AccountChange struct {
+	Password    [32]byte `json:"password"`
+	NewPassword [32]byte `json:"new_password"`
+	NewLogin    string   `json:"new_login,omitempty"`
+}
+
+// accountCommand готовит смену пароля, логина или удаление аккаунта, спрашивая текущий пароль
+func (user *User) accountCommand(input *lineReader, command string, value string) (Msg, bool) {
+	msg := Msg{Sender: user.Login}
+	account := &AccountChange{}
+	switch command {
+	case "password":
+		msg.Type = TypePasswordChange
+		newPassword := prompt(input, "New password: ")
+		if newPassword == "" || newPassword != prompt(input, "Repeat new password: ") {
+			fmt.Println("Passwords are empty or do not match")
+			return msg, false
+		}
+		account.NewPassword = sha256.Sum256([]byte(newPassword))
+	case "rename":
+		if !checkLoginIsCorrect(value) || value == "" {
+			fmt.Println("Usage: rename <new login>, login may contain only latin letters and digits")
+			return msg, false
+		}
+		msg.Type = TypeRename
+		account.NewLogin = value
+	case "delete":
+		if prompt(input, "All your data will be deleted. Type DELETE to confirm: ") != "DELETE" {
+			fmt.Println("Account was not deleted")
+			return msg, false
+		}
+		msg.Type = TypeAccountDelete
+	default:
+		return msg, false
+	}
+	account.Password = sha256.Sum256([]byte(prompt(input, "Current password: ")))
+	msg.Account = account
+	return msg, true
+}
+
+func prompt(input *lineReader, text string) string {
+	fmt.Print(text)
+	line, ok := input.Line()
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(line)
+}
+
+// applyAccountChange применяет подтвержденное сервером изменение аккаунта; вызывать под user.mutex
+func (user *User) applyAccountChange(msg Msg) {
+	switch msg.Type {
+	case TypePasswordChange:
+		fmt.Println("Password changed")
+	case TypeRename:
+		fmt.Printf("Login changed from %s to %s\n", msg.Text, msg.Receiver)
+		user.Login = msg.Receiver
+		user.names[msg.Receiver] = user.names[msg.Text]
+		if user.profile != nil {
+			user.profile.Login = msg.Receiver
+		}
+	case TypeAccountDelete:
+		fmt.Println("Account deleted")
+	}
+	select {
+	case user.profileUpdated <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminHelp = "Commands: online, kick <login> [reason], ban <login> <duration, e.g. 24h|forever> [reason],\n" +
+	"unban <login>, unlock <login>, announce <text>, stats, role <login> user|moderator|admin,\n" +
+	"reports, resolve <report id> [note], dismiss <report id> [note], back"
+
+type UserInfo struct {
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+type Report struct {
+	ID        int    `json:"id"`
+	MessageID int    `json:"message_id"`
+	Sender    string `json:"sender"`
+	Receiver  string `json:"receiver"`
+	Text      string `json:"text"`
+	Reporter  string `json:"reporter,omitempty"`
+	Source    string `json:"source"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ServerStats struct {
+	Uptime        int64 `json:"uptime"`
+	Connections   int   `json:"connections"`
+	OnlineUsers   int   `json:"online_users"`
+	Users         int64 `json:"users"`
+	Conversations int64 `json:"conversations"`
+	Messages      int64 `json:"messages"`
+	Dropped       int64 `json:"dropped"`
+	Spilled       int64 `json:"spilled"`
+	Disconnected  int64 `json:"disconnected"`
+}
+
+// handleAdmin - экран команд администрирования; ответы сервера печатаются по мере прихода
+func handleAdmin(user *User, input *lineReader) {
+	clearScreen()
+	fmt.Println("ADMIN")
+	fmt.Println(adminHelp)
+	for !stop {
+		line, ok := input.Line()
+		if !ok {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "back" {
+			return
+		}
+		msg, ok := adminCommand(fields)
+		if !ok {
+			fmt.Println("Unknown command. " + adminHelp)
+			continue
+		}
+		msg.Sender = user.Login
+		err := sendMessage(user.conn, msg)
+		if err != nil {
+			user.logger.Println("Error sending admin command:", err)
+			return
+		}
+	}
+}
+
+func adminCommand(fields []string) (Msg, bool) {
+	msg := Msg{Type: TypeAdmin, Command: fields[0], Timestamp: time.Now().UnixMilli()}
+	args := fields[1:]
+	switch msg.Command {
+	case "online", "stats", "reports":
+		return msg, len(args) == 0
+	case "resolve", "dismiss":
+		if len(args) == 0 {
+			return msg, false
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return msg, false
+		}
+		msg.ID = id
+		msg.Text = strings.Join(args[1:], " ")
+	case "announce":
+		msg.Text = strings.Join(args, " ")
+		return msg, msg.Text != ""
+	case "unban", "unlock":
+		if len(args) != 1 {
+			return msg, false
+		}
+		msg.Receiver = args[0]
+	case "kick":
+		if len(args) == 0 {
+			return msg, false
+		}
+		msg.Receiver = args[0]
+		msg.Text = strings.Join(args[1:], " ")
+	case "ban":
+		if len(args) < 2 {
+			return msg, false
+		}
+		msg.Receiver = args[0]
+		if args[1] != "forever" {
+			duration, err := time.ParseDuration(args[1])
+			if err != nil || duration <= 0 {
+				return msg, false
+			}
+			msg.Until = time.Now().Add(duration).UnixMilli()
+		}
+		msg.Text = strings.Join(args[2:], " ")
+	case "role":
+		if len(args) != 2 {
+			return msg, false
+		}
+		msg.Receiver = args[0]
+		msg.Role = args[1]
+	default:
+		return msg, false
+	}
+	return msg, true
+}
+
+func printAdminReply(msg Msg) {
+	switch msg.Command {
+	case "online":
+		fmt.Printf("Online: %d\n", len(msg.Users))
+		for _, user := range msg.Users {
+			fmt.Println("    " + user.Login + " (" + user.Role + ")")
+		}
+	case "stats":
+		if msg.Stats == nil {
+			return
+		}
+		stats := msg.Stats
+		fmt.Println("Uptime: " + (time.Duration(stats.Uptime) * time.Second).String())
+		fmt.Println("Connections: " + strconv.Itoa(stats.Connections) + ", online users: " + strconv.Itoa(stats.OnlineUsers))
+		fmt.Printf("Users: %d, conversations: %d, messages: %d\n", stats.Users, stats.Conversations, stats.Messages)
+		fmt.Printf("Send queues: dropped %d, spilled %d, disconnected %d\n", stats.Dropped, stats.Spilled, stats.Disconnected)
+	case "reports":
+		fmt.Printf("Open reports: %d\n", len(msg.Reports))
+		for _, report := range msg.Reports {
+			from := report.Reporter
+			if from == "" {
+				from = report.Source
+			}
+			fmt.Printf("#%d %s by %s: message #%d %s -> %s: %s\n", report.ID, formatTime(report.CreatedAt), from,
+				report.MessageID, report.Sender, report.Receiver, report.Text)
+			if report.Reason != "" {
+				fmt.Println("    reason: " + report.Reason)
+			}
+		}
+	case "ban":
+		until := "forever"
+		if msg.Until < time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli() {
+			until = "until " + formatTime(msg.Until)
+		}
+		fmt.Println(msg.Text + " " + until)
+	default:
+		fmt.Println(msg.Text)
+	}
+}
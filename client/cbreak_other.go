@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+// на остальных системах ввод остается построчным, и индикатор набора не отправляется
+func enableCbreak(fd int) (func(), error) {
+	return nil, errors.New("cbreak mode is not supported on this platform")
+}
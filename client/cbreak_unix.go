@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// enableCbreak выключает построчный ввод и эхо терминала, но оставляет обработку
+// вывода и сигналов, чтобы сообщения из другой горутины печатались как обычно;
+// возвращает функцию, которая восстанавливает прежний режим
+func enableCbreak(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+	cbreak := *old
+	cbreak.Lflag &^= unix.ICANON | unix.ECHO
+	cbreak.Cc[unix.VMIN] = 1
+	cbreak.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, ioctlWriteTermios, &cbreak)
+	if err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlWriteTermios, old) }, nil
+}
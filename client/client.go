@@ -8,25 +8,139 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"time"
 	"strconv"
 	"strings"
 )
 
+const (
+	TypeChat      = ""
+	TypeGoingAway = "going_away"
+	TypePing      = "ping"
+	TypePong      = "pong"
+	TypeThrottled = "throttled"
+	TypeError     = "error"
+	TypeEdit      = "edit"
+	TypeDelete    = "delete"
+	TypeReact     = "react"
+	TypeUnreact   = "unreact"
+
+	TypeUploadStart   = "upload_start"
+	TypeUploadChunk   = "upload_chunk"
+	TypeUploadDone    = "upload_done"
+	TypeUploadAbort   = "upload_abort"
+	TypeDownload      = "download"
+	TypeDownloadChunk = "download_chunk"
+	TypeDownloadDone  = "download_done"
+
+	TypeSearch        = "search"
+	TypeSearchResults = "search_results"
+	TypeTyping        = "typing"
+	TypeConversations = "conversations"
+	TypeRead          = "read"
+	TypeContacts      = "contacts"
+	TypeContactAdd    = "contact_add"
+	TypeContactRemove = "contact_remove"
+	TypeBlock         = "block"
+	TypeUnblock       = "unblock"
+	TypePrivacy       = "privacy"
+	TypeProfile       = "profile"
+	TypeProfileUpdate = "profile_update"
+
+	TypePasswordChange = "password_change"
+	TypeRename         = "rename"
+	TypeAccountDelete  = "account_delete"
+
+	TypeAdmin        = "admin"
+	TypeAnnouncement = "announcement"
+	TypeReport       = "report"
+)
+
+const (
+	PurposeAttachment = ""
+	PurposeAvatar     = "avatar"
+)
+
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+const (
+	heartbeatInterval = 20 * time.Second
+	// сервер пингует раз в 30 секунд, так что тишина дольше idleTimeout - обрыв связи
+	idleTimeout = 90 * time.Second
+
+	// столько символов исходного сообщения сервер кладет в цитату
+	quoteLength = 80
+)
+
 type Msg struct {
+	Type      string `json:"type,omitempty"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Timestamp int64  `json:"timestamp"`
 	Text      string `json:"text"`
 	Status    int64  `json:"status"`
+	Code      string `json:"code,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+	Edited    bool   `json:"edited,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ReplyTo   int    `json:"reply_to,omitempty"`
+	Quote     string `json:"quote,omitempty"`
+	ThreadID  int    `json:"thread_id,omitempty"`
+	Emoji     string `json:"emoji,omitempty"`
+
+	Reactions map[string]int `json:"reactions,omitempty"`
+
+	Attachment *Attachment `json:"attachment,omitempty"`
+	Upload     string      `json:"upload,omitempty"`
+	Offset     int64       `json:"offset,omitempty"`
+	Data       []byte      `json:"data,omitempty"`
+
+	Since   int64 `json:"since,omitempty"`
+	Until   int64 `json:"until,omitempty"`
+	Results []Msg `json:"results,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+
+	Conversations []ConversationInfo `json:"conversations,omitempty"`
+
+	Contacts []string         `json:"contacts,omitempty"`
+	Blocked  []string         `json:"blocked,omitempty"`
+	Privacy  *PrivacySettings `json:"privacy,omitempty"`
+
+	Purpose string   `json:"purpose,omitempty"`
+	Profile *Profile `json:"profile,omitempty"`
+
+	Account *AccountChange `json:"account,omitempty"`
+
+	Command string       `json:"command,omitempty"`
+	Role    string       `json:"role,omitempty"`
+	Users   []UserInfo   `json:"users,omitempty"`
+	Stats   *ServerStats `json:"stats,omitempty"`
+	Reports []Report     `json:"reports,omitempty"`
 }
 
+const (
+	AuthOk          = 0
+	AuthFailed      = 2
+	AuthUnavailable = 3
+	AuthThrottled   = 4
+	AuthLocked      = 5
+	AuthInvalid     = 6
+	AuthBanned      = 7
+)
+
 type AuthMsg struct {
 	Login        string   `json:"login"`
 	HashPassword [32]byte `json:"hash_password"`
 	Timestamp    int64    `json:"timestamp"`
 	Status       int64    `json:"status"`
+	Code         string   `json:"code,omitempty"`
 }
 
 type User struct {
@@ -36,6 +150,27 @@ type User struct {
 	conn  net.Conn
 	chats map[string][]Msg
 
+	upload    *pendingUpload
+	downloads map[string]*download
+
+	// открытая сейчас переписка и до какого времени печатает каждый собеседник
+	dialog     string
+	typing     map[string]time.Time
+	lastTyping time.Time
+
+	// список переписок, сначала самые недавно активные
+	conversations []ConversationInfo
+
+	contacts        []string
+	blocked         []string
+	privacy         *PrivacySettings
+	contactsUpdated chan struct{}
+
+	// отображаемые имена по логинам и свой профиль
+	names          map[string]string
+	profile        *Profile
+	profileUpdated chan struct{}
+
 	fileLogger *os.File
 	logger     *log.Logger
 
@@ -46,7 +181,7 @@ var (
 	stop bool = false
 )
 
-func registerOrAuth(ip string, port int, scanner *bufio.Scanner, status int64) *User {
+func registerOrAuth(ip string, port int, input *lineReader, status int64) *User {
 	conn, err := net.Dial("tcp", ip + ":" + strconv.Itoa(port))
 	if err != nil {
 		log.Fatal(err)
@@ -65,16 +200,13 @@ func registerOrAuth(ip string, port int, scanner *bufio.Scanner, status int64) *
 	logger := log.Default()
 	logger.SetOutput(f)
 	fmt.Print("Write login: ")
-	scanner.Scan()
-	login := scanner.Text()
+	login, _ := input.Line()
 	for !checkLoginIsCorrect(login) {
 		fmt.Print("Incorrect login. Write login: ")
-		scanner.Scan()
-		login = scanner.Text()
+		login, _ = input.Line()
 	}
 	fmt.Print("Write password: ")
-	scanner.Scan()
-	password := scanner.Text()
+	password, _ := input.Line()
 	authMsg := AuthMsg{
 		Login:        login,
 		HashPassword: sha256.Sum256([]byte(password)),
@@ -99,7 +231,27 @@ func registerOrAuth(ip string, port int, scanner *bufio.Scanner, status int64) *
 		logger.Println("Error unmarshalling response:", err)
 		return nil
 	}
-	if authMsg.Status != 0 {
+	if authMsg.Status == AuthUnavailable {
+		fmt.Println("Server is temporarily unavailable, try again later")
+		return nil
+	}
+	if authMsg.Status == AuthThrottled {
+		fmt.Println("Too many attempts, try again later")
+		return nil
+	}
+	if authMsg.Status == AuthLocked {
+		fmt.Println("Too many failed logins, locked until " + time.Unix(authMsg.Timestamp, 0).Format("2006-01-02 15:04:05"))
+		return nil
+	}
+	if authMsg.Status == AuthBanned {
+		fmt.Println("Account is banned until " + time.Unix(authMsg.Timestamp, 0).Format("2006-01-02 15:04:05"))
+		return nil
+	}
+	if authMsg.Status == AuthInvalid {
+		fmt.Println("Server rejected login: " + authMsg.Code)
+		return nil
+	}
+	if authMsg.Status != AuthOk {
 		fmt.Println("Incorrect password")
 		return nil
 	}
@@ -111,6 +263,12 @@ func registerOrAuth(ip string, port int, scanner *bufio.Scanner, status int64) *
 		logger:     logger,
 		fileLogger: f,
 		chats:      make(map[string][]Msg),
+		downloads:  make(map[string]*download),
+		typing:     make(map[string]time.Time),
+		names:      make(map[string]string),
+
+		contactsUpdated: make(chan struct{}, 1),
+		profileUpdated:  make(chan struct{}, 1),
 	}
 	return &user
 }
@@ -133,21 +291,166 @@ func checkLoginIsCorrect(login string) bool {
 	return true
 }
 
+// addToChat вставляет сообщение в переписку по его порядковому номеру; вызывать под user.mutex
+func (user *User) addToChat(peer string, msg Msg) {
+	chat := user.chats[peer]
+	i := len(chat)
+	for i > 0 && chat[i-1].Seq > msg.Seq {
+		i--
+	}
+	user.chats[peer] = append(chat[:i], append([]Msg{msg}, chat[i:]...)...)
+}
+
+// peerOf возвращает собеседника в переписке, к которой относится сообщение
+func (user *User) peerOf(msg Msg) string {
+	if msg.Sender == user.Login {
+		return msg.Receiver
+	}
+	return msg.Sender
+}
+
+// applyChange применяет к переписке правку или удаление сообщения; вызывать под user.mutex
+func (user *User) applyChange(msg Msg) {
+	peer := user.peerOf(msg)
+	chat := user.chats[peer]
+	// цитаты в ответах следуют за исходным сообщением
+	for i := range chat {
+		if chat[i].ReplyTo != msg.ID {
+			continue
+		}
+		if msg.Type == TypeDelete {
+			chat[i].Quote = ""
+		} else {
+			chat[i].Quote = quoteOf(msg.Text)
+		}
+	}
+	for i := range chat {
+		if chat[i].ID != msg.ID {
+			continue
+		}
+		switch {
+		case msg.Type == TypeDelete && msg.Scope == DeleteForMe:
+			user.chats[peer] = append(chat[:i], chat[i+1:]...)
+		case msg.Type == TypeDelete:
+			chat[i].Text = ""
+			chat[i].Deleted = true
+			chat[i].Reactions = nil
+		default:
+			chat[i].Text = msg.Text
+			chat[i].Edited = true
+		}
+		return
+	}
+}
+
+// applyReaction заменяет счетчики реакций сообщения присланными сервером; вызывать под user.mutex
+func (user *User) applyReaction(msg Msg) {
+	chat := user.chats[user.peerOf(msg)]
+	for i := range chat {
+		if chat[i].ID == msg.ID {
+			chat[i].Reactions = msg.Reactions
+			return
+		}
+	}
+}
+
+// formatReactions выводит реакции в стабильном порядке, например "👍 2  🎉 1"
+func formatReactions(reactions map[string]int) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = emoji + " " + strconv.Itoa(reactions[emoji])
+	}
+	return strings.Join(parts, "  ")
+}
+
+// quoteOf обрезает текст до длины цитаты, которую присылает сервер
+func quoteOf(text string) string {
+	runes := []rune(text)
+	if len(runes) > quoteLength {
+		runes = runes[:quoteLength]
+	}
+	return string(runes)
+}
+
+// printMsg печатает сообщение переписки; вызывать под user.mutex
+func (user *User) printMsg(msg Msg) {
+	if msg.ReplyTo != 0 {
+		quote := msg.Quote
+		if quote == "" {
+			quote = "message deleted"
+		}
+		fmt.Printf("  > #%d %s\n", msg.ReplyTo, quote)
+	}
+	text := msg.Text
+	if msg.Deleted {
+		text = "message deleted"
+	} else if msg.Edited {
+		text += " (edited)"
+	}
+	fmt.Printf("#%d %s %s %s\n", msg.ID, user.displayName(msg.Sender), formatTime(msg.Timestamp), text)
+	if msg.Attachment != nil {
+		fmt.Printf("    [file #%d %s, %s] /save %d\n", msg.Attachment.ID, msg.Attachment.Name,
+			formatSize(msg.Attachment.Size), msg.Attachment.ID)
+	}
+	if len(msg.Reactions) > 0 {
+		fmt.Println("    " + formatReactions(msg.Reactions))
+	}
+}
+
+// formatTime форматирует время сообщения в миллисекундах Unix
+func formatTime(timestamp int64) string {
+	return time.UnixMilli(timestamp).Format("2006-01-02 15:04:05")
+}
+
 func clearScreen() {
 	fmt.Print("\033[2J") // Очищает экран
 	fmt.Print("\033[H")  // Перемещает курсор в левый верхний угол
 }
 
-func handleUser(user *User) {
+func (user *User) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := sendMessage(user.conn, Msg{Type: TypePing, Timestamp: time.Now().UnixMilli()})
+			if err != nil {
+				user.logger.Println("Error sending ping:", err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func handleUser(user *User, input *lineReader) {
+	done := make(chan struct{})
+	defer close(done)
+	go user.heartbeat(done)
+
 
 	//обрабатываем получаемые сообщения
 	go func() {
 		reader := bufio.NewReader(user.conn)
-		var msg Msg
 		for {
+			var msg Msg
+			user.conn.SetReadDeadline(time.Now().Add(idleTimeout))
 			input, err := reader.ReadString('\n')
 			if err != nil {
 				user.logger.Println("Error reading input:", err)
+				select {
+				case <-done:
+					// пользователь сам вышел из чата
+				default:
+					fmt.Println("Connection to server lost")
+					stop = true
+				}
 				return
 			}
 			if len(input) == 0 {
@@ -157,22 +460,76 @@ func handleUser(user *User) {
 			if err != nil {
 				user.logger.Println("Error unmarshalling input:", err)
 			}
+			if msg.Type == TypePing {
+				sendMessage(user.conn, Msg{Type: TypePong, Timestamp: time.Now().UnixMilli()})
+				continue
+			}
+			if msg.Type == TypePong {
+				continue
+			}
+			if msg.Type == TypeTyping {
+				user.mutex.Lock()
+				user.setTyping(msg)
+				user.mutex.Unlock()
+				continue
+			}
+			if msg.Type == TypeUploadStart || msg.Type == TypeDownloadChunk || msg.Type == TypeDownloadDone {
+				user.mutex.Lock()
+				user.handleTransfer(msg)
+				user.mutex.Unlock()
+				continue
+			}
 			fmt.Println(msg)
+			if msg.Type == TypeGoingAway {
+				fmt.Println("Server: " + msg.Text)
+				user.logger.Println("Server going away: " + msg.Text)
+				stop = true
+				return
+			}
 			user.mutex.Lock()
-			if msg.Status != 0 {
+			if msg.Type == TypeThrottled {
+				fmt.Println("You are sending messages too fast: " + msg.Text)
+				user.logger.Println("Throttled: " + msg.Text)
+			} else if msg.Type == TypeError {
+				// ошибка могла прийти в ответ на upload_start, и тогда id загрузки уже не будет
+				user.upload = nil
+				fmt.Println("Message to " + msg.Receiver + " rejected: " + msg.Text)
+				user.logger.Println("Error " + msg.Code + ": " + msg.Text)
+			} else if msg.Type == TypeEdit || msg.Type == TypeDelete {
+				user.applyChange(msg)
+				user.refreshLast(user.peerOf(msg))
+			} else if msg.Type == TypeReact || msg.Type == TypeUnreact {
+				user.applyReaction(msg)
+			} else if msg.Type == TypeSearchResults {
+				user.printSearchResults(msg)
+			} else if msg.Type == TypeProfile && msg.Profile != nil {
+				user.setProfile(msg.Profile)
+			} else if msg.Type == TypePasswordChange || msg.Type == TypeRename || msg.Type == TypeAccountDelete {
+				user.applyAccountChange(msg)
+			} else if msg.Type == TypeAdmin {
+				printAdminReply(msg)
+			} else if msg.Type == TypeReport {
+				fmt.Printf("Message #%d: %s\n", msg.ID, msg.Text)
+			} else if msg.Type == TypeAnnouncement {
+				fmt.Println("Announcement from " + msg.Sender + ": " + msg.Text)
+			} else if msg.Type == TypeContacts || msg.Type == TypePrivacy {
+				user.setContacts(msg)
+			} else if msg.Type == TypeConversations {
+				user.setConversations(msg.Conversations)
+			} else if msg.Type == TypeRead && len(msg.Conversations) == 1 {
+				user.updateConversation(msg.Conversations[0])
+			} else if msg.Status != 0 {
 				fmt.Println(msg.Text)
 				user.logger.Println("Error: " + msg.Text)
-			} else if msg.Sender == user.Login {
-				user.chats[msg.Receiver] = append(user.chats[msg.Receiver], msg)
 			} else {
-				user.chats[msg.Sender] = append(user.chats[msg.Sender], msg)
+				user.addToChat(user.peerOf(msg), msg)
+				user.stopTyping(msg.Sender)
+				user.noteMessage(msg)
 			}
 			user.mutex.Unlock()
 		}
 	}()
 
-	scanner := bufio.NewScanner(os.Stdin)
-
 	for {
 		clearScreen()
 		if stop {
@@ -180,26 +537,32 @@ func handleUser(user *User) {
 		}
 		fmt.Println("DIALOGS")
 		user.mutex.Lock()
-		for login, msgs := range user.chats {
-			fmt.Println(login, msgs[len(msgs)-1].Sender, time.Unix(msgs[len(msgs)-1].Timestamp, 0).Format("2006-01-02 15:04:05"), msgs[len(msgs)-1].Text)
+		for _, info := range user.conversations {
+			user.printConversation(info)
 		}
 		user.mutex.Unlock()
-		fmt.Println("You can:\n1.Change dialog\n2.Exit")
-		scanner.Scan()
-		text := scanner.Text()
+		// ответ придет, пока пользователь выбирает действие, и попадет на следующий экран
+		user.requestConversations()
+		fmt.Println("You can:\n1.Change dialog\n2.Exit\n3.Contacts\n4.Profile\n5.Admin")
+		text, _ := input.Line()
 		if len(text) == 0 {
 			continue
 		}
 		if text == "1" || text == "Change dialog" {
 			fmt.Print("Write username: ")
-			scanner.Scan()
-			text = scanner.Text()
-			handleDialog(user, text)
+			text, _ = input.Line()
+			handleDialog(user, text, input)
+		} else if text == "3" || text == "Contacts" {
+			handleContacts(user, input)
+		} else if text == "4" || text == "Profile" {
+			handleProfile(user, input)
+		} else if text == "5" || text == "Admin" {
+			handleAdmin(user, input)
 		} else if text == "2" || text == "Exit" {
 			msg := Msg{
 				Sender:    user.Login,
 				Receiver:  user.Login,
-				Timestamp: time.Now().Unix(),
+				Timestamp: time.Now().UnixMilli(),
 				Text:      "disconnect",
 				Status:    1,
 			}
@@ -215,20 +578,43 @@ func handleUser(user *User) {
 	}
 }
 
-func handleDialog(user *User, dialog string) {
-	scanner := bufio.NewScanner(os.Stdin)
+func handleDialog(user *User, dialog string, input *lineReader) {
+	user.mutex.Lock()
+	user.dialog = dialog
+	user.markRead(dialog)
+	user.mutex.Unlock()
+	defer func() {
+		user.mutex.Lock()
+		user.dialog = ""
+		user.mutex.Unlock()
+	}()
+
+	// id корня открытой ветки; 0 - вся переписка
+	thread := 0
 	for {
 		clearScreen()
 		if stop {
 			break
 		}
 		user.mutex.Lock()
+		fmt.Println(user.dialogHeader(dialog))
+		user.mutex.Unlock()
+		fmt.Println(dialogHelp)
+		if thread != 0 {
+			fmt.Printf("Thread #%d, /thread to leave\n", thread)
+		}
+		user.mutex.Lock()
 		for _, msg := range user.chats[dialog] {
-			fmt.Println(msg.Sender, time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04:05"), msg.Text)
+			if thread != 0 && msg.ID != thread && msg.ThreadID != thread {
+				continue
+			}
+			user.printMsg(msg)
 		}
 		user.mutex.Unlock()
-		scanner.Scan()
-		text := scanner.Text()
+		text, ok := input.ReadLine(func(line string) { user.sendTyping(dialog, line) })
+		if !ok {
+			break
+		}
 		if len(text) == 0 {
 			continue
 		}
@@ -238,9 +624,24 @@ func handleDialog(user *User, dialog string) {
 		msg := Msg{
 			Sender:    user.Login,
 			Receiver:  dialog,
-			Timestamp: time.Now().Unix(),
+			Timestamp: time.Now().UnixMilli(),
 			Text:      text,
 		}
+		if text == "/thread" || strings.HasPrefix(text, "/thread ") {
+			thread = threadCommand(text)
+			continue
+		}
+		if thread != 0 && !strings.HasPrefix(text, "/") {
+			// в открытой ветке обычный текст - ответ на ее первое сообщение
+			msg.ReplyTo = thread
+		}
+		if strings.HasPrefix(text, "/") {
+			var ok bool
+			msg, ok = dialogCommand(user, dialog, text)
+			if !ok {
+				continue
+			}
+		}
 		err := sendMessage(user.conn, msg)
 		if err != nil {
 			user.logger.Println("Error sending disconnect message:", err)
@@ -264,26 +665,26 @@ func main() {
 		}
 	}()
 
-	scanner := bufio.NewScanner(os.Stdin)
+	// все экраны читают stdin через один буфер, иначе часть ввода теряется между ними
+	input := newLineReader()
 	for {
 		if stop {
 			break
 		}
 		fmt.Println("You can:\n1.Register\n2.Auth\n3.Exit")
-		scanner.Scan()
-		text := scanner.Text()
+		text, _ := input.Line()
 		if text == "1" || text == "Register" {
-			user = registerOrAuth(ip, port, scanner, 0)
+			user = registerOrAuth(ip, port, input, 0)
 			if user == nil {
 				continue
 			}
-			handleUser(user)
+			handleUser(user, input)
 		} else if text == "2" || text == "Auth" {
-			user = registerOrAuth(ip, port, scanner, 1)
+			user = registerOrAuth(ip, port, input, 1)
 			if user == nil {
 				continue
 			}
-			handleUser(user)
+			handleUser(user, input)
 		} else if text == "3" || text == "Exit" {
 			break
 		} else {
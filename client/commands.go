@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dialogHelp = "Commands: /reply <id> <text>, /thread [id], /edit <id> <text>, /delete <id> [all],\n" +
+	"/react <id> <emoji>, /unreact <id> <emoji>, /file <path> [caption], /save <file id> [dir],\n" +
+	"/search <words> [peer:<login>|peer:all] [since:YYYY-MM-DD] [until:YYYY-MM-DD],\n" +
+	"/profile [login], /avatar [login] [dir], /report <id> [reason], exit"
+
+// dialogCommand разбирает команду вида /name args из окна переписки с dialog;
+// возвращает сообщение для сервера или false, если отправлять нечего
+func dialogCommand(user *User, dialog string, text string) (Msg, bool) {
+	name, args, _ := strings.Cut(text, " ")
+	msg := Msg{
+		Sender:    user.Login,
+		Receiver:  dialog,
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	switch name {
+	case "/reply":
+		idText, replyText, _ := strings.Cut(args, " ")
+		id, err := strconv.Atoi(idText)
+		if err != nil || replyText == "" {
+			fmt.Println("Usage: /reply <id> <text>")
+			return msg, false
+		}
+		msg.ReplyTo = id
+		msg.Text = replyText
+	case "/edit":
+		idText, newText, _ := strings.Cut(args, " ")
+		id, err := strconv.Atoi(idText)
+		if err != nil || newText == "" {
+			fmt.Println("Usage: /edit <id> <text>")
+			return msg, false
+		}
+		msg.Type = TypeEdit
+		msg.ID = id
+		msg.Text = newText
+	case "/delete":
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			fmt.Println("Usage: /delete <id> [all]")
+			return msg, false
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			fmt.Println("Usage: /delete <id> [all]")
+			return msg, false
+		}
+		msg.Type = TypeDelete
+		msg.ID = id
+		msg.Scope = DeleteForMe
+		if len(fields) > 1 && fields[1] == "all" {
+			msg.Scope = DeleteForEveryone
+		}
+	case "/react", "/unreact":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			fmt.Printf("Usage: %s <id> <emoji>\n", name)
+			return msg, false
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			fmt.Printf("Usage: %s <id> <emoji>\n", name)
+			return msg, false
+		}
+		msg.Type = TypeReact
+		if name == "/unreact" {
+			msg.Type = TypeUnreact
+		}
+		msg.ID = id
+		msg.Emoji = fields[1]
+	case "/file":
+		path, caption, _ := strings.Cut(args, " ")
+		if path == "" {
+			fmt.Println("Usage: /file <path> [caption]")
+			return msg, false
+		}
+		msg.Text = caption
+		return user.startUpload(msg, path)
+	case "/save":
+		fields := strings.Fields(args)
+		if len(fields) == 0 || len(fields) > 2 {
+			fmt.Println("Usage: /save <file id> [dir]")
+			return msg, false
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			fmt.Println("Usage: /save <file id> [dir]")
+			return msg, false
+		}
+		dir := "downloads"
+		if len(fields) == 2 {
+			dir = fields[1]
+		}
+		err = os.MkdirAll(dir, 0o755)
+		if err != nil {
+			fmt.Println(err)
+			return msg, false
+		}
+		msg.Type = TypeDownload
+		msg.ID = id
+		user.mutex.Lock()
+		user.downloads[downloadKey(msg)] = &download{dir: dir}
+		user.mutex.Unlock()
+	case "/search":
+		return searchCommand(msg, args)
+	case "/profile":
+		msg.Type = TypeProfile
+		if args != "" {
+			msg.Receiver = strings.TrimSpace(args)
+		}
+	case "/avatar":
+		return user.avatarCommand(msg, args)
+	case "/report":
+		idText, reason, _ := strings.Cut(args, " ")
+		id, err := strconv.Atoi(idText)
+		if err != nil {
+			fmt.Println("Usage: /report <id> [reason]")
+			return msg, false
+		}
+		msg.Type = TypeReport
+		msg.ID = id
+		msg.Text = strings.TrimSpace(reason)
+	default:
+		fmt.Println("Unknown command. " + dialogHelp)
+		return msg, false
+	}
+	return msg, true
+}
+
+// threadCommand разбирает /thread [id] и возвращает корень ветки для показа;
+// без id или с некорректным id возвращает 0, то есть всю переписку
+func threadCommand(text string) int {
+	_, args, _ := strings.Cut(text, " ")
+	id, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil || id < 0 {
+		return 0
+	}
+	return id
+}
+
+// searchCommand собирает запрос поиска; по умолчанию ищет в текущей переписке
+func searchCommand(msg Msg, args string) (Msg, bool) {
+	msg.Type = TypeSearch
+	var words []string
+	for _, field := range strings.Fields(args) {
+		key, value, found := strings.Cut(field, ":")
+		if !found {
+			words = append(words, field)
+			continue
+		}
+		switch key {
+		case "peer":
+			msg.Receiver = value
+			if value == "all" {
+				msg.Receiver = ""
+			}
+		case "since", "until":
+			day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				fmt.Println("Dates must look like 2024-12-31")
+				return msg, false
+			}
+			if key == "since" {
+				msg.Since = day.UnixMilli()
+			} else {
+				// until включает весь указанный день
+				msg.Until = day.AddDate(0, 0, 1).UnixMilli()
+			}
+		default:
+			words = append(words, field)
+		}
+	}
+	if len(words) == 0 {
+		fmt.Println("Usage: /search <words> [peer:<login>|peer:all] [since:YYYY-MM-DD] [until:YYYY-MM-DD]")
+		return msg, false
+	}
+	msg.Text = strings.Join(words, " ")
+	return msg, true
+}
+
+// printSearchResults печатает найденные сообщения; вызывать под user.mutex
+func (user *User) printSearchResults(msg Msg) {
+	fmt.Printf("Search %q: %d found\n", msg.Text, len(msg.Results))
+	for _, result := range msg.Results {
+		fmt.Print(result.Receiver + ": ")
+		user.printMsg(result)
+	}
+}
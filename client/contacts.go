@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const contactsHelp = "Commands: add <login>, remove <login>, block <login>, unblock <login>,\n" +
+	"privacy messages|online everyone|contacts|nobody, back"
+
+// сколько ждать ответа сервера, прежде чем перерисовать экран контактов
+const contactsReplyTimeout = time.Second
+
+type PrivacySettings struct {
+	Messages string `json:"messages"`
+	Online   string `json:"online"`
+}
+
+// setContacts сохраняет присланные сервером списки и будит экран контактов; вызывать под user.mutex
+func (user *User) setContacts(msg Msg) {
+	if msg.Type == TypePrivacy {
+		user.privacy = msg.Privacy
+	} else {
+		user.contacts = msg.Contacts
+		user.blocked = msg.Blocked
+	}
+	select {
+	case user.contactsUpdated <- struct{}{}:
+	default:
+	}
+}
+
+// waitContacts ждет ответа на запрос с экрана контактов
+func (user *User) waitContacts() {
+	select {
+	case <-user.contactsUpdated:
+	case <-time.After(contactsReplyTimeout):
+	}
+}
+
+func handleContacts(user *User, input *lineReader) {
+	sendMessage(user.conn, Msg{Type: TypeContacts, Timestamp: time.Now().UnixMilli()})
+	user.waitContacts()
+	sendMessage(user.conn, Msg{Type: TypePrivacy, Timestamp: time.Now().UnixMilli()})
+	user.waitContacts()
+	for {
+		clearScreen()
+		if stop {
+			return
+		}
+		user.mutex.Lock()
+		fmt.Println("CONTACTS")
+		fmt.Println("Contacts: " + strings.Join(user.contacts, ", "))
+		fmt.Println("Blocked: " + strings.Join(user.blocked, ", "))
+		if user.privacy != nil {
+			fmt.Printf("Who can message me: %s, who can see me online: %s\n", user.privacy.Messages, user.privacy.Online)
+		}
+		user.mutex.Unlock()
+		fmt.Println(contactsHelp)
+
+		line, ok := input.Line()
+		if !ok {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "back" {
+			return
+		}
+		msg, ok := user.contactsCommand(fields)
+		if !ok {
+			fmt.Println("Unknown command. " + contactsHelp)
+			time.Sleep(contactsReplyTimeout)
+			continue
+		}
+		err := sendMessage(user.conn, msg)
+		if err != nil {
+			user.logger.Println("Error sending contacts command:", err)
+			return
+		}
+		user.waitContacts()
+	}
+}
+
+func (user *User) contactsCommand(fields []string) (Msg, bool) {
+	msg := Msg{Sender: user.Login, Timestamp: time.Now().UnixMilli()}
+	if len(fields) != 2 && !(fields[0] == "privacy" && len(fields) == 3) {
+		return msg, false
+	}
+	switch fields[0] {
+	case "add":
+		msg.Type = TypeContactAdd
+	case "remove":
+		msg.Type = TypeContactRemove
+	case "block":
+		msg.Type = TypeBlock
+	case "unblock":
+		msg.Type = TypeUnblock
+	case "privacy":
+		user.mutex.Lock()
+		settings := PrivacySettings{Messages: "everyone", Online: "everyone"}
+		if user.privacy != nil {
+			settings = *user.privacy
+		}
+		user.mutex.Unlock()
+		switch fields[1] {
+		case "messages":
+			settings.Messages = fields[2]
+		case "online":
+			settings.Online = fields[2]
+		default:
+			return msg, false
+		}
+		msg.Type = TypePrivacy
+		msg.Privacy = &settings
+		return msg, true
+	default:
+		return msg, false
+	}
+	msg.Receiver = fields[1]
+	return msg, true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type ConversationInfo struct {
+	ID          int    `json:"id"`
+	Peer        string `json:"peer"`
+	PeerName    string `json:"peer_name,omitempty"`
+	PeerOnline  bool   `json:"peer_online"`
+	LastReadSeq int64  `json:"last_read_seq"`
+	Unread      int    `json:"unread"`
+
+	LastSeq        int64  `json:"last_seq"`
+	LastSender     string `json:"last_sender,omitempty"`
+	LastText       string `json:"last_text,omitempty"`
+	LastDeleted    bool   `json:"last_deleted,omitempty"`
+	LastAttachment string `json:"last_attachment,omitempty"`
+	LastActivity   int64  `json:"last_activity"`
+}
+
+// setConversations заменяет список переписок присланным сервером; вызывать под user.mutex
+func (user *User) setConversations(infos []ConversationInfo) {
+	user.conversations = infos
+	for _, info := range infos {
+		user.names[info.Peer] = info.PeerName
+	}
+	user.sortConversations()
+}
+
+// updateConversation заменяет одну строку списка; вызывать под user.mutex
+func (user *User) updateConversation(info ConversationInfo) {
+	user.names[info.Peer] = info.PeerName
+	*user.conversation(info.Peer) = info
+	user.sortConversations()
+}
+
+// conversation возвращает строку списка для собеседника, добавляя ее при необходимости; вызывать под user.mutex
+func (user *User) conversation(peer string) *ConversationInfo {
+	for i := range user.conversations {
+		if user.conversations[i].Peer == peer {
+			return &user.conversations[i]
+		}
+	}
+	user.conversations = append(user.conversations, ConversationInfo{Peer: peer})
+	return &user.conversations[len(user.conversations)-1]
+}
+
+func (user *User) sortConversations() {
+	sort.SliceStable(user.conversations, func(i, j int) bool {
+		return user.conversations[i].LastActivity > user.conversations[j].LastActivity
+	})
+}
+
+// noteMessage обновляет список по новому сообщению: в открытой переписке оно сразу
+// прочитано, в остальных увеличивает счетчик; вызывать под user.mutex
+func (user *User) noteMessage(msg Msg) {
+	peer := user.peerOf(msg)
+	info := user.conversation(peer)
+	if msg.Seq >= info.LastSeq {
+		info.LastSeq = msg.Seq
+		info.LastSender = msg.Sender
+		info.LastText = quoteOf(msg.Text)
+		info.LastDeleted = msg.Deleted
+		info.LastAttachment = ""
+		if msg.Attachment != nil {
+			info.LastAttachment = msg.Attachment.Name
+		}
+		info.LastActivity = msg.Timestamp
+	}
+	if msg.Sender != user.Login {
+		if user.dialog == peer {
+			user.markRead(peer)
+		} else {
+			info.Unread++
+		}
+	}
+	user.sortConversations()
+}
+
+// refreshLast обновляет превью после правки или удаления последнего сообщения; вызывать под user.mutex
+func (user *User) refreshLast(peer string) {
+	chat := user.chats[peer]
+	if len(chat) == 0 {
+		return
+	}
+	last := chat[len(chat)-1]
+	info := user.conversation(peer)
+	if last.Seq == info.LastSeq {
+		info.LastText = quoteOf(last.Text)
+		info.LastDeleted = last.Deleted
+	}
+}
+
+// markRead отправляет отметку о прочтении переписки до последнего известного сообщения; вызывать под user.mutex
+func (user *User) markRead(peer string) {
+	chat := user.chats[peer]
+	if len(chat) == 0 {
+		return
+	}
+	user.conversation(peer).Unread = 0
+	err := sendMessage(user.conn, Msg{
+		Type:      TypeRead,
+		Receiver:  peer,
+		Timestamp: time.Now().UnixMilli(),
+		Seq:       chat[len(chat)-1].Seq,
+	})
+	if err != nil {
+		user.logger.Println("Error sending read mark:", err)
+	}
+}
+
+// requestConversations просит сервер прислать актуальный список переписок
+func (user *User) requestConversations() {
+	err := sendMessage(user.conn, Msg{Type: TypeConversations, Timestamp: time.Now().UnixMilli()})
+	if err != nil {
+		user.logger.Println("Error requesting conversations:", err)
+	}
+}
+
+// printConversation печатает строку списка переписок; вызывать под user.mutex
+func (user *User) printConversation(info ConversationInfo) {
+	status := ""
+	if info.PeerOnline {
+		status = " [online]"
+	}
+	if info.Unread > 0 {
+		status += fmt.Sprintf(" (%d unread)", info.Unread)
+	}
+	fmt.Println(user.displayName(info.Peer) + status)
+	if info.LastSeq == 0 {
+		return
+	}
+	text := info.LastText
+	switch {
+	case info.LastDeleted:
+		text = "message deleted"
+	case text == "" && info.LastAttachment != "":
+		text = "[file " + info.LastAttachment + "]"
+	}
+	fmt.Printf("    %s %s: %s\n", formatTime(info.LastActivity), info.LastSender, text)
+}
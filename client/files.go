@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ограничение сервера на размер файла
+	maxAttachmentSize = 20 << 20
+	// размер куска при загрузке; сервер принимает до 64 КБ
+	uploadChunkSize = 48 << 10
+)
+
+type Attachment struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256"`
+}
+
+// pendingUpload - файл, для которого отправлен upload_start и ждется id загрузки
+type pendingUpload struct {
+	path     string
+	receiver string
+	purpose  string
+}
+
+// download - скачиваемое вложение, которое пишется во временный файл в каталоге dir
+type download struct {
+	dir  string
+	file *os.File
+	hash []byte
+}
+
+// startUpload готовит upload_start для файла path; загрузка на соединении одна за раз
+func (user *User) startUpload(msg Msg, path string) (Msg, bool) {
+	user.mutex.Lock()
+	busy := user.upload != nil
+	user.mutex.Unlock()
+	if busy {
+		fmt.Println("Another file is being uploaded")
+		return msg, false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return msg, false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		fmt.Println("Not a file: " + path)
+		return msg, false
+	}
+	maxSize := int64(maxAttachmentSize)
+	if msg.Purpose == PurposeAvatar {
+		maxSize = maxAvatarSize
+	}
+	if info.Size() == 0 || info.Size() > maxSize {
+		fmt.Printf("File must be from 1 byte to %d MB\n", maxSize>>20)
+		return msg, false
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		fmt.Println(err)
+		return msg, false
+	}
+
+	user.mutex.Lock()
+	user.upload = &pendingUpload{path: path, receiver: msg.Receiver, purpose: msg.Purpose}
+	user.mutex.Unlock()
+	msg.Type = TypeUploadStart
+	msg.Attachment = &Attachment{
+		Name:   filepath.Base(path),
+		Size:   info.Size(),
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}
+	return msg, true
+}
+
+// sendFile отправляет файл кусками после того, как сервер выдал id загрузки
+func (user *User) sendFile(upload *pendingUpload, id string) {
+	abort := func(err error) {
+		user.logger.Println("Upload failed:", err)
+		fmt.Println("Upload failed:", err)
+		sendMessage(user.conn, Msg{Type: TypeUploadAbort, Upload: id})
+	}
+	file, err := os.Open(upload.path)
+	if err != nil {
+		abort(err)
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sendErr := sendMessage(user.conn, Msg{Type: TypeUploadChunk, Upload: id, Offset: offset, Data: buf[:n]})
+			if sendErr != nil {
+				abort(sendErr)
+				return
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			abort(err)
+			return
+		}
+	}
+	err = sendMessage(user.conn, Msg{
+		Type:      TypeUploadDone,
+		Upload:    id,
+		Receiver:  upload.receiver,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		user.logger.Println("Upload failed:", err)
+	}
+}
+
+// handleTransfer обрабатывает служебные кадры передачи файлов; вызывать под user.mutex
+func (user *User) handleTransfer(msg Msg) {
+	switch msg.Type {
+	case TypeUploadStart:
+		if user.upload == nil {
+			return
+		}
+		go user.sendFile(user.upload, msg.Upload)
+		user.upload = nil
+	case TypeDownloadChunk:
+		key := downloadKey(msg)
+		d, ok := user.downloads[key]
+		if !ok {
+			return
+		}
+		if d.file == nil {
+			file, err := os.CreateTemp(d.dir, ".download-*")
+			if err != nil {
+				user.failDownload(key, err)
+				return
+			}
+			d.file = file
+		}
+		_, err := d.file.Write(msg.Data)
+		if err != nil {
+			user.failDownload(key, err)
+		}
+	case TypeDownloadDone:
+		key := downloadKey(msg)
+		d, ok := user.downloads[key]
+		if !ok || msg.Attachment == nil {
+			return
+		}
+		delete(user.downloads, key)
+		attachment := *msg.Attachment
+		if msg.Purpose == PurposeAvatar {
+			attachment.Name = avatarFileName(msg.Receiver, attachment.ContentType)
+		}
+		path, err := d.finish(attachment)
+		if err != nil {
+			fmt.Println("Download failed:", err)
+			user.logger.Println("Download failed:", err)
+			return
+		}
+		fmt.Println("File saved to " + path)
+	}
+}
+
+// downloadKey - ключ скачивания в user.downloads: id вложения или логин для аватара
+func downloadKey(msg Msg) string {
+	if msg.Purpose == PurposeAvatar {
+		return "avatar:" + msg.Receiver
+	}
+	return strconv.Itoa(msg.ID)
+}
+
+func avatarFileName(login string, contentType string) string {
+	ext := ""
+	exts, err := mime.ExtensionsByType(contentType)
+	if err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	return login + "-avatar" + ext
+}
+
+func (user *User) failDownload(key string, err error) {
+	d := user.downloads[key]
+	delete(user.downloads, key)
+	if d.file != nil {
+		d.file.Close()
+		os.Remove(d.file.Name())
+	}
+	fmt.Println("Download failed:", err)
+	user.logger.Println("Download failed:", err)
+}
+
+// finish проверяет контрольную сумму и переименовывает временный файл,
+// не затирая уже существующие файлы с тем же именем
+func (d *download) finish(attachment Attachment) (string, error) {
+	if d.file == nil {
+		return "", fmt.Errorf("no data received")
+	}
+	tmpName := d.file.Name()
+	defer os.Remove(tmpName)
+	_, err := d.file.Seek(0, io.SeekStart)
+	if err == nil {
+		hash := sha256.New()
+		_, err = io.Copy(hash, d.file)
+		if err == nil && hex.EncodeToString(hash.Sum(nil)) != attachment.SHA256 {
+			err = fmt.Errorf("checksum mismatch")
+		}
+	}
+	d.file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(strings.ReplaceAll(attachment.Name, "\\", "/"))
+	ext := filepath.Ext(name)
+	path := filepath.Join(d.dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(d.dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	return path, os.Rename(tmpName, path)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
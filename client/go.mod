@@ -1,3 +1,8 @@
 module client
 
 go 1.23.4
+
+require (
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
+)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// lineReader - единственный читатель stdin в клиенте: у каждого читателя свой буфер,
+// и прочитанное одним из них другой уже не увидит. В диалоге строка читается из терминала
+// посимвольно, чтобы знать, когда пользователь печатает; если stdin не терминал,
+// строки читаются как обычно
+type lineReader struct {
+	in *bufio.Reader
+	fd int
+}
+
+func newLineReader() *lineReader {
+	return &lineReader{in: bufio.NewReader(os.Stdin), fd: int(os.Stdin.Fd())}
+}
+
+// Line читает строку целиком без посимвольной обработки; false означает конец ввода
+func (r *lineReader) Line() (string, bool) {
+	line, err := r.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// ReadLine возвращает введенную строку; onKey вызывается после каждого изменения
+// строки с ее текущим содержимым; false означает конец ввода
+func (r *lineReader) ReadLine(onKey func(line string)) (string, bool) {
+	var restore func()
+	var err error
+	if term.IsTerminal(r.fd) {
+		restore, err = enableCbreak(r.fd)
+	}
+	if restore == nil || err != nil {
+		return r.Line()
+	}
+	defer restore()
+
+	var line []byte
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return string(line), len(line) > 0
+		}
+		switch {
+		case c == '\n' || c == '\r':
+			fmt.Println()
+			return string(line), true
+		case c == 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", false
+			}
+		case c == 127 || c == '\b':
+			if len(line) > 0 {
+				_, size := utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+				fmt.Print("\b \b")
+				onKey(string(line))
+			}
+		case unicode.IsPrint(c):
+			line = utf8.AppendRune(line, c)
+			fmt.Print(string(c))
+			onKey(string(line))
+		}
+	}
+}
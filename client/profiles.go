@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const profileHelp = "Commands: name <display name>, bio <text>, timezone <zone, e.g. Europe/Moscow>,\n" +
+	"avatar <path>, password, rename <login>, delete, back; an empty value clears the field"
+
+// ограничение сервера на размер аватара
+const maxAvatarSize = 1 << 20
+
+type Profile struct {
+	Login       string      `json:"login"`
+	DisplayName string      `json:"display_name"`
+	Bio         string      `json:"bio"`
+	Timezone    string      `json:"timezone"`
+	Avatar      *Attachment `json:"avatar,omitempty"`
+}
+
+// displayName возвращает имя для показа вместо логина; вызывать под user.mutex
+func (user *User) displayName(login string) string {
+	name := user.names[login]
+	if name == "" || name == login {
+		return login
+	}
+	return name + " (" + login + ")"
+}
+
+// setProfile запоминает присланный профиль; чужие и запрошенные из переписки профили
+// печатает сразу, свой показывает экран профиля; вызывать под user.mutex
+func (user *User) setProfile(profile *Profile) {
+	user.names[profile.Login] = profile.DisplayName
+	if profile.Login == user.Login {
+		user.profile = profile
+		select {
+		case user.profileUpdated <- struct{}{}:
+		default:
+		}
+	}
+	if profile.Login != user.Login || user.dialog != "" {
+		printProfile(profile)
+	}
+}
+
+func printProfile(profile *Profile) {
+	name := profile.DisplayName
+	if name == "" {
+		name = profile.Login
+	}
+	fmt.Printf("%s (%s)\n", name, profile.Login)
+	if profile.Bio != "" {
+		fmt.Println("    " + profile.Bio)
+	}
+	if profile.Timezone != "" {
+		zone := profile.Timezone
+		location, err := time.LoadLocation(profile.Timezone)
+		if err == nil {
+			zone += ", local time " + time.Now().In(location).Format("15:04")
+		}
+		fmt.Println("    Timezone: " + zone)
+	}
+	if profile.Avatar != nil {
+		fmt.Printf("    Avatar: %s, %s, /avatar %s\n", profile.Avatar.ContentType, formatSize(profile.Avatar.Size), profile.Login)
+	}
+}
+
+// waitProfile ждет ответа на запрос с экрана профиля
+func (user *User) waitProfile() {
+	select {
+	case <-user.profileUpdated:
+	case <-time.After(contactsReplyTimeout):
+	}
+}
+
+func handleProfile(user *User, input *lineReader) {
+	sendMessage(user.conn, Msg{Type: TypeProfile, Timestamp: time.Now().UnixMilli()})
+	user.waitProfile()
+	for {
+		clearScreen()
+		if stop {
+			return
+		}
+		fmt.Println("PROFILE")
+		user.mutex.Lock()
+		if user.profile != nil {
+			printProfile(user.profile)
+		}
+		user.mutex.Unlock()
+		fmt.Println(profileHelp)
+
+		line, ok := input.Line()
+		if !ok {
+			return
+		}
+		command, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if command == "" {
+			continue
+		}
+		if command == "back" {
+			return
+		}
+		var msg Msg
+		switch command {
+		case "password", "rename", "delete":
+			msg, ok = user.accountCommand(input, command, strings.TrimSpace(value))
+		default:
+			msg, ok = user.profileCommand(command, strings.TrimSpace(value))
+		}
+		if !ok {
+			time.Sleep(contactsReplyTimeout)
+			continue
+		}
+		err := sendMessage(user.conn, msg)
+		if err != nil {
+			user.logger.Println("Error sending profile command:", err)
+			return
+		}
+		if msg.Type == TypeUploadStart {
+			// аватар загружается в фоне, ответ придет после последнего куска
+			fmt.Println("Uploading avatar...")
+			time.Sleep(contactsReplyTimeout)
+			continue
+		}
+		user.waitProfile()
+	}
+}
+
+func (user *User) profileCommand(command string, value string) (Msg, bool) {
+	msg := Msg{Sender: user.Login, Timestamp: time.Now().UnixMilli()}
+	if command == "avatar" {
+		if value == "" {
+			fmt.Println("Usage: avatar <path>")
+			return msg, false
+		}
+		msg.Purpose = PurposeAvatar
+		return user.startUpload(msg, value)
+	}
+
+	user.mutex.Lock()
+	profile := Profile{Login: user.Login}
+	if user.profile != nil {
+		profile = *user.profile
+	}
+	user.mutex.Unlock()
+	switch command {
+	case "name":
+		profile.DisplayName = value
+	case "bio":
+		profile.Bio = value
+	case "timezone":
+		profile.Timezone = value
+	default:
+		fmt.Println("Unknown command. " + profileHelp)
+		return msg, false
+	}
+	profile.Avatar = nil
+	msg.Type = TypeProfileUpdate
+	msg.Profile = &profile
+	return msg, true
+}
+
+// avatarCommand разбирает /avatar [login] [dir] и готовит скачивание аватара
+func (user *User) avatarCommand(msg Msg, args string) (Msg, bool) {
+	fields := strings.Fields(args)
+	if len(fields) > 2 {
+		fmt.Println("Usage: /avatar [login] [dir]")
+		return msg, false
+	}
+	if len(fields) > 0 {
+		msg.Receiver = fields[0]
+	}
+	dir := "downloads"
+	if len(fields) == 2 {
+		dir = fields[1]
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		fmt.Println(err)
+		return msg, false
+	}
+	msg.Type = TypeDownload
+	msg.Purpose = PurposeAvatar
+	user.mutex.Lock()
+	user.downloads[downloadKey(msg)] = &download{dir: dir}
+	user.mutex.Unlock()
+	return msg, true
+}
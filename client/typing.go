@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// чаще этого событие "печатает" не отправляется; сервер держит индикатор несколько секунд
+const typingInterval = 3 * time.Second
+
+// sendTyping сообщает собеседнику, что пользователь набирает сообщение;
+// команды и пустая строка набором не считаются
+func (user *User) sendTyping(dialog string, line string) {
+	if line == "" || strings.HasPrefix(line, "/") || time.Since(user.lastTyping) < typingInterval {
+		return
+	}
+	user.lastTyping = time.Now()
+	err := sendMessage(user.conn, Msg{Type: TypeTyping, Receiver: dialog, Timestamp: time.Now().UnixMilli()})
+	if err != nil {
+		user.logger.Println("Error sending typing:", err)
+	}
+}
+
+// setTyping запоминает, до какого времени собеседник печатает, и обновляет заголовок
+// открытой переписки сейчас и после истечения события; вызывать под user.mutex
+func (user *User) setTyping(msg Msg) {
+	expires := time.UnixMilli(msg.Expires)
+	user.typing[msg.Sender] = expires
+	user.redrawHeader(msg.Sender)
+	time.AfterFunc(time.Until(expires), func() {
+		user.mutex.Lock()
+		defer user.mutex.Unlock()
+		if !time.Now().Before(user.typing[msg.Sender]) {
+			delete(user.typing, msg.Sender)
+			user.redrawHeader(msg.Sender)
+		}
+	})
+}
+
+// stopTyping снимает индикатор, когда от собеседника пришло сообщение; вызывать под user.mutex
+func (user *User) stopTyping(peer string) {
+	if _, ok := user.typing[peer]; ok {
+		delete(user.typing, peer)
+		user.redrawHeader(peer)
+	}
+}
+
+// dialogHeader - первая строка экрана переписки; вызывать под user.mutex
+func (user *User) dialogHeader(dialog string) string {
+	header := "Dialog with " + user.displayName(dialog)
+	if time.Now().Before(user.typing[dialog]) {
+		header += " - typing..."
+	}
+	return header
+}
+
+// redrawHeader перерисовывает первую строку экрана, не сдвигая курсор ввода; вызывать под user.mutex
+func (user *User) redrawHeader(dialog string) {
+	if user.dialog != dialog {
+		return
+	}
+	fmt.Print("\0337\033[1;1H\033[2K" + user.dialogHeader(dialog) + "\0338")
+}
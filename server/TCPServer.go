@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
-	"os"
+	"path/filepath"
+	"server/logging"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TCPServer struct {
@@ -15,31 +20,78 @@ type TCPServer struct {
 	port     int
 
 	realConnection sync.WaitGroup
+	accepting      atomic.Bool
 
-	logger     *log.Logger
-	fileLogger *os.File
+	logger     *slog.Logger
+	fileLogger io.Closer
 }
 
-func NewTCPServer(domain string, port int) (*TCPServer, error) {
+func NewTCPServer(domain string, port int, config Config) (*TCPServer, error) {
 	listener, err := net.Listen("tcp", domain+":"+strconv.Itoa(port))
 	if err != nil {
 		return nil, err
 	}
 
-	logger := log.Default()
-	fileLogger, err := os.Create("logs/tcp_server.log")
+	logger, fileLogger, err := logging.New(filepath.Join(config.LogDir, "tcp_server.log"), config.Log)
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
-	logger.SetOutput(fileLogger)
-	logger.Println("Starting TCP Server")
+	logger = logger.With("component", "tcp_server", "addr", listener.Addr().String())
+	logger.Info("Starting TCP Server")
 	server := &TCPServer{listener: listener, domain: domain, port: port, logger: logger, fileLogger: fileLogger}
 	return server, nil
 }
 
+// Serve принимает соединения, пока не будет вызван StopAccepting
+func (server *TCPServer) Serve(handler func(net.Conn)) {
+	server.accepting.Store(true)
+	defer server.accepting.Store(false)
+	for {
+		conn, err := server.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			server.logger.Info("Listener closed")
+			return
+		}
+		if err != nil {
+			server.logger.Error("accept", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		server.realConnection.Add(1)
+		go func() {
+			defer server.realConnection.Done()
+			handler(conn)
+		}()
+	}
+}
+
+func (server *TCPServer) Accepting() bool {
+	return server.accepting.Load()
+}
+
+func (server *TCPServer) StopAccepting() {
+	server.logger.Info("Stop accepting connections")
+	server.listener.Close()
+}
+
+// WaitConnections ждет завершения обработчиков; false, если не дождались за timeout
+func (server *TCPServer) WaitConnections(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		server.realConnection.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (server *TCPServer) Close() {
-	server.logger.Println("Closing TCP Server")
-	server.realConnection.Wait()
+	server.logger.Info("Closing TCP Server")
 	server.listener.Close()
 	server.fileLogger.Close()
 }
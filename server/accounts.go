@@ -0,0 +1,163 @@
+package main
+
+import (
+	"time"
+
+	"server/database"
+	"server/handlers"
+	"server/utility"
+	"server/validation"
+)
+
+// account меняет пароль или логин либо удаляет аккаунт после проверки текущего пароля;
+// возвращает true, если соединение нужно закрыть
+func (server *Server) account(connection *Connection, user *handlers.User, ip string, msg handlers.Msg) bool {
+	server.mutex.Lock()
+	err := database.CheckPassword(server.DB, user.Id, utility.ToHex(msg.Account.Password))
+	server.mutex.Unlock()
+	if err == database.ErrWrongPassword {
+		return server.reauthFailed(connection, user, ip, msg)
+	}
+	if err != nil {
+		server.logger.Error("check password", "user", user.Login, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return false
+	}
+	server.authGuard.Success(user.Login, ip)
+
+	switch msg.Type {
+	case handlers.TypePasswordChange:
+		err = server.changePassword(connection, user, ip, msg.Account)
+	case handlers.TypeRename:
+		err = server.rename(connection, user, ip, msg.Account.NewLogin)
+	case handlers.TypeAccountDelete:
+		err = server.deleteAccount(connection, user, ip)
+		if err == nil {
+			return true
+		}
+	}
+	if err != nil {
+		server.logger.Info("account change", "user", user.Login, "action", msg.Type, "error", err)
+		connection.Send(errorMsg(msg, err))
+	}
+	return false
+}
+
+// reauthFailed учитывает неверный пароль так же, как неудачный вход: с задержкой
+// ответа и блокировкой после порога, при которой соединение закрывается
+func (server *Server) reauthFailed(connection *Connection, user *handlers.User, ip string, msg handlers.Msg) bool {
+	server.metrics.Logins.WithLabelValues("failed").Inc()
+	delay, locked := server.authGuard.Failure(user.Login, ip)
+	server.auditAuth(user.Login, ip, database.AuthEventLoginFailed)
+	if locked {
+		server.logger.Warn("too many failed password checks, locked", "user", user.Login)
+		server.auditAuth(user.Login, ip, database.AuthEventLocked)
+		connection.SendWait(goingAwayMsg("too many failed password attempts"))
+		return true
+	}
+	time.Sleep(delay)
+	connection.Send(errorMsg(msg, database.ErrWrongPassword))
+	return false
+}
+
+func (server *Server) changePassword(connection *Connection, user *handlers.User, ip string, account *handlers.AccountChange) error {
+	hash := utility.ToHex(account.NewPassword)
+	server.mutex.Lock()
+	err := database.ChangePassword(server.DB, user.Id, hash)
+	if err == nil {
+		user.HashPassword = hash
+		server.revokeSessions(user.Id, connection, "password was changed")
+	}
+	server.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	server.logger.Info("password changed", "user", user.Login)
+	server.auditAuth(user.Login, ip, database.AuthEventPassword)
+	return connection.Send(handlers.Msg{
+		Type:      handlers.TypePasswordChange,
+		Receiver:  user.Login,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      "password changed",
+	})
+}
+
+// rename меняет логин; собеседники видят новый логин, потому что переписки
+// и сообщения ссылаются на пользователя по id
+func (server *Server) rename(connection *Connection, user *handlers.User, ip string, login string) error {
+	server.mutex.Lock()
+	oldLogin := user.Login
+	if login == oldLogin {
+		server.mutex.Unlock()
+		return validation.ErrSameLogin
+	}
+	err := database.RenameUser(server.DB, user.Id, login)
+	if err == nil {
+		user.Login = login
+	}
+	server.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	server.logger.Info("user renamed", "user", login, "old_login", oldLogin)
+	server.auditAuth(oldLogin, ip, database.AuthEventRenamed)
+	return connection.Send(handlers.Msg{
+		Type:      handlers.TypeRename,
+		Receiver:  login,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      oldLogin,
+	})
+}
+
+// deleteAccount удаляет аккаунт по политике из конфигурации и закрывает все его соединения
+func (server *Server) deleteAccount(connection *Connection, user *handlers.User, ip string) error {
+	policy := server.config.AccountDeletePolicy
+	server.mutex.Lock()
+	keys, err := database.DeleteUser(server.DB, user.Id, policy)
+	server.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		server.deleteBlob(key)
+	}
+	server.logger.Info("account deleted", "user", user.Login, "policy", policy, "blobs", len(keys))
+	server.auditAuth(user.Login, ip, database.AuthEventDeleted)
+
+	connection.SendWait(handlers.Msg{
+		Type:      handlers.TypeAccountDelete,
+		Receiver:  user.Login,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      "account deleted",
+	})
+	server.mutex.Lock()
+	for _, other := range server.connections {
+		if other.userId == user.Id {
+			other.accountDeleted = true
+		}
+	}
+	server.revokeSessions(user.Id, nil, "account was deleted")
+	server.mutex.Unlock()
+	return nil
+}
+
+// revokeSessions закрывает соединения пользователя, кроме keep; вызывать под server.mutex
+func (server *Server) revokeSessions(userID int, keep *Connection, reason string) {
+	for _, connection := range server.connections {
+		if connection.userId != userID || connection == keep {
+			continue
+		}
+		connection.Send(goingAwayMsg(reason))
+		connection.CloseAfterFlush()
+		server.logger.Info("session revoked", "conn_id", connection.id, "reason", reason)
+	}
+}
+
+func goingAwayMsg(reason string) handlers.Msg {
+	return handlers.Msg{
+		Type:      handlers.TypeGoingAway,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      reason,
+		Status:    1,
+	}
+}
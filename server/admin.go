@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"server/database"
+	"server/handlers"
+	"server/validation"
+)
+
+var (
+	errForbidden = errors.New("you do not have permission for this command")
+	errNotLocked = errors.New("account is not locked")
+)
+
+// commandRoles - минимальная роль для каждой команды admin
+var commandRoles = map[string]string{
+	handlers.AdminOnline:   handlers.RoleModerator,
+	handlers.AdminKick:     handlers.RoleModerator,
+	handlers.AdminBan:      handlers.RoleModerator,
+	handlers.AdminUnban:    handlers.RoleModerator,
+	handlers.AdminUnlock:   handlers.RoleModerator,
+	handlers.AdminReports:  handlers.RoleModerator,
+	handlers.AdminResolve:  handlers.RoleModerator,
+	handlers.AdminDismiss:  handlers.RoleModerator,
+	handlers.AdminAnnounce: handlers.RoleAdmin,
+	handlers.AdminStats:    handlers.RoleAdmin,
+	handlers.AdminRole:     handlers.RoleAdmin,
+}
+
+var roleRanks = map[string]int{
+	handlers.RoleUser:      0,
+	handlers.RoleModerator: 1,
+	handlers.RoleAdmin:     2,
+}
+
+// targetsUser - команды, которые действуют на пользователя из Receiver
+func targetsUser(command string) bool {
+	switch command {
+	case handlers.AdminKick, handlers.AdminBan, handlers.AdminUnban, handlers.AdminRole:
+		return true
+	}
+	return false
+}
+
+func (server *Server) validateAdmin(msg *handlers.Msg) error {
+	if _, ok := commandRoles[msg.Command]; !ok {
+		return validation.ErrBadCommand
+	}
+	if targetsUser(msg.Command) || msg.Command == handlers.AdminUnlock {
+		receiver, err := validation.NormalizeLogin(msg.Receiver)
+		if err != nil {
+			return err
+		}
+		msg.Receiver = receiver
+	}
+	var err error
+	switch msg.Command {
+	case handlers.AdminAnnounce:
+		msg.Text, err = validation.NormalizeText(msg.Text, server.config.MaxMessageLength)
+	case handlers.AdminKick, handlers.AdminBan, handlers.AdminResolve, handlers.AdminDismiss:
+		if (msg.Command == handlers.AdminResolve || msg.Command == handlers.AdminDismiss) && msg.ID <= 0 {
+			return validation.ErrNoReportID
+		}
+		if msg.Text != "" {
+			msg.Text, err = validation.NormalizeText(msg.Text, validation.MaxReasonLength)
+		}
+		if msg.Command == handlers.AdminBan && msg.Until != 0 && msg.Until <= time.Now().UnixMilli() {
+			err = validation.ErrBadBanTime
+		}
+	case handlers.AdminRole:
+		if _, ok := roleRanks[msg.Role]; !ok {
+			err = validation.ErrBadRole
+		}
+	}
+	return err
+}
+
+// admin выполняет команду администрирования, если роли пользователя хватает,
+// и записывает в admin_audit и выполненные, и отклоненные команды
+func (server *Server) admin(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	role, err := database.GetRole(server.DB, user.Id)
+	if err == nil && roleRanks[role] < roleRanks[commandRoles[msg.Command]] {
+		err = errForbidden
+	}
+	var target *handlers.User
+	if err == nil && targetsUser(msg.Command) {
+		target, err = database.GetUserByLogin(server.DB, msg.Receiver)
+		// действовать можно только на пользователей с ролью ниже своей
+		if err == nil && (target.Id == user.Id || roleRanks[target.Role] >= roleRanks[role]) {
+			err = errForbidden
+		}
+	}
+	reply := handlers.Msg{
+		Type:      handlers.TypeAdmin,
+		Command:   msg.Command,
+		Receiver:  msg.Receiver,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err == nil {
+		err = server.runAdminCommand(user, target, msg, &reply)
+	}
+
+	result := database.AuditOk
+	switch {
+	case err == errForbidden:
+		result = database.AuditDenied
+	case err != nil:
+		result = database.AuditFailed
+	}
+	server.auditAdmin(user.Login, msg, result)
+	// снятие блокировки видно и в журнале входов аккаунта, как при /admin/unlock
+	if err == nil && msg.Command == handlers.AdminUnlock {
+		auditErr := database.AddAuthEvent(server.DB, msg.Receiver, remoteIP(connection.conn), database.AuthEventUnlocked)
+		if auditErr != nil {
+			server.logger.Error("audit auth event", "user", msg.Receiver, "event", database.AuthEventUnlocked, "error", auditErr)
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		connection.Send(handlers.Msg{Type: handlers.TypeError, Receiver: msg.Receiver, Timestamp: time.Now().UnixMilli(),
+			Text: "user not found", Status: 1, Code: "user_not_found"})
+		return
+	}
+	if err != nil {
+		server.logger.Warn("admin command", "user", user.Login, "command", msg.Command, "target", msg.Receiver, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	server.logger.Info("admin command", "user", user.Login, "command", msg.Command, "target", msg.Receiver)
+	connection.Send(reply)
+}
+
+// runAdminCommand выполняет проверенную команду и заполняет ответ; вызывать под server.mutex
+func (server *Server) runAdminCommand(user *handlers.User, target *handlers.User, msg handlers.Msg, reply *handlers.Msg) error {
+	switch msg.Command {
+	case handlers.AdminOnline:
+		users, err := database.GetOnlineUsers(server.DB)
+		reply.Users = users
+		return err
+	case handlers.AdminKick:
+		server.revokeSessions(target.Id, nil, withReason("kicked by "+user.Login, msg.Text))
+		reply.Text = target.Login + " kicked"
+	case handlers.AdminBan:
+		until := database.PermanentBan
+		if msg.Until != 0 {
+			until = time.UnixMilli(msg.Until)
+		}
+		err := database.BanUser(server.DB, target.Id, until, msg.Text)
+		if err != nil {
+			return err
+		}
+		server.revokeSessions(target.Id, nil, withReason("banned by "+user.Login, msg.Text))
+		reply.Until = until.UnixMilli()
+		reply.Text = target.Login + " banned"
+	case handlers.AdminUnban:
+		err := database.UnbanUser(server.DB, target.Id)
+		if err != nil {
+			return err
+		}
+		reply.Text = target.Login + " unbanned"
+	case handlers.AdminUnlock:
+		if !server.authGuard.Unlock(msg.Receiver) {
+			return errNotLocked
+		}
+		reply.Text = msg.Receiver + " unlocked"
+	case handlers.AdminAnnounce:
+		announcement := handlers.Msg{
+			Type:      handlers.TypeAnnouncement,
+			Sender:    user.Login,
+			Timestamp: time.Now().UnixMilli(),
+			Text:      msg.Text,
+		}
+		for _, connection := range server.Conns {
+			connection.Send(announcement)
+		}
+		reply.Text = "announcement sent"
+	case handlers.AdminStats:
+		stats := &handlers.ServerStats{
+			Uptime:       int64(time.Since(server.startedAt).Seconds()),
+			Connections:  len(server.connections),
+			OnlineUsers:  len(server.Conns),
+			Dropped:      server.queueStats.Dropped.Load(),
+			Spilled:      server.queueStats.Spilled.Load(),
+			Disconnected: server.queueStats.Disconnected.Load(),
+		}
+		err := database.CountRows(server.DB, stats)
+		if err != nil {
+			return err
+		}
+		reply.Stats = stats
+	case handlers.AdminRole:
+		err := database.SetRole(server.DB, target.Id, msg.Role)
+		if err != nil {
+			return err
+		}
+		reply.Role = msg.Role
+		reply.Text = target.Login + " is now " + msg.Role
+	case handlers.AdminReports:
+		reports, err := database.GetOpenReports(server.DB)
+		reply.Reports = reports
+		return err
+	case handlers.AdminResolve, handlers.AdminDismiss:
+		status := handlers.ReportResolved
+		if msg.Command == handlers.AdminDismiss {
+			status = handlers.ReportDismissed
+		}
+		err := database.CloseReport(server.DB, msg.ID, user.Id, status)
+		if err != nil {
+			return err
+		}
+		reply.ID = msg.ID
+		reply.Text = "report #" + strconv.Itoa(msg.ID) + " " + status
+	}
+	return nil
+}
+
+func withReason(text string, reason string) string {
+	if reason == "" {
+		return text
+	}
+	return text + ": " + reason
+}
+
+// auditAdmin записывает команду в admin_audit; вызывать под server.mutex
+func (server *Server) auditAdmin(actor string, msg handlers.Msg, result string) {
+	details := msg.Text
+	switch msg.Command {
+	case handlers.AdminBan:
+		until := "permanent"
+		if msg.Until != 0 {
+			until = time.UnixMilli(msg.Until).UTC().Format(time.RFC3339)
+		}
+		details = withReason("until "+until, msg.Text)
+	case handlers.AdminRole:
+		details = msg.Role
+	case handlers.AdminResolve, handlers.AdminDismiss:
+		details = withReason("report #"+strconv.Itoa(msg.ID), msg.Text)
+	}
+	err := database.AddAdminAudit(server.DB, actor, msg.Command, msg.Receiver, details, result)
+	if err != nil {
+		server.logger.Error("admin audit", "user", actor, "command", msg.Command, "error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// authFailures - неудачные попытки входа для одного аккаунта или адреса
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// AuthGuard считает неудачные входы по аккаунтам и адресам, замедляет ответы
+// на них и временно блокирует вход после порога
+type AuthGuard struct {
+	mutex sync.Mutex
+	// ключ - логин в нижнем регистре: в базе логины сравниваются без учета регистра
+	accounts map[string]*authFailures
+	ips      map[string]*authFailures
+	// текущее время; подменяется в тестах
+	now func() time.Time
+
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	accountThreshold int
+	ipThreshold      int
+	lockoutDuration  time.Duration
+	failureWindow    time.Duration
+}
+
+func NewAuthGuard(config Config) *AuthGuard {
+	return &AuthGuard{
+		accounts:         make(map[string]*authFailures),
+		ips:              make(map[string]*authFailures),
+		now:              time.Now,
+		baseDelay:        config.AuthFailureBaseDelay,
+		maxDelay:         config.AuthFailureMaxDelay,
+		accountThreshold: config.AccountLockoutThreshold,
+		ipThreshold:      config.IPLockoutThreshold,
+		lockoutDuration:  config.LockoutDuration,
+		failureWindow:    config.AuthFailureWindow,
+	}
+}
+
+// Locked сообщает, заблокирован ли вход для аккаунта или адреса, и до какого времени
+func (guard *AuthGuard) Locked(login string, ip string) (bool, time.Time) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	now := guard.now()
+	var until time.Time
+	for _, failures := range []*authFailures{guard.accounts[accountKey(login)], guard.ips[ip]} {
+		if failures != nil && failures.lockedUntil.After(now) && failures.lockedUntil.After(until) {
+			until = failures.lockedUntil
+		}
+	}
+	return !until.IsZero(), until
+}
+
+// Failure учитывает неудачную попытку; возвращает задержку перед ответом
+// и признак того, что аккаунт или адрес только что заблокирован
+func (guard *AuthGuard) Failure(login string, ip string) (time.Duration, bool) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	account := guard.record(guard.accounts, accountKey(login))
+	address := guard.record(guard.ips, ip)
+
+	locked := false
+	now := guard.now()
+	if guard.accountThreshold > 0 && account.count >= guard.accountThreshold && !account.lockedUntil.After(now) {
+		account.lockedUntil = now.Add(guard.lockoutDuration)
+		account.count = 0
+		locked = true
+	}
+	if guard.ipThreshold > 0 && address.count >= guard.ipThreshold && !address.lockedUntil.After(now) {
+		address.lockedUntil = now.Add(guard.lockoutDuration)
+		address.count = 0
+		locked = true
+	}
+
+	count := max(account.count, address.count, 1)
+	delay := guard.baseDelay << min(count-1, 16)
+	if delay > guard.maxDelay {
+		delay = guard.maxDelay
+	}
+	return delay, locked
+}
+
+func (guard *AuthGuard) record(table map[string]*authFailures, key string) *authFailures {
+	failures, ok := table[key]
+	if !ok {
+		failures = &authFailures{}
+		table[key] = failures
+	}
+	now := guard.now()
+	if now.Sub(failures.lastFailure) > guard.failureWindow {
+		failures.count = 0
+	}
+	failures.count++
+	failures.lastFailure = now
+	return failures
+}
+
+// Success сбрасывает счетчики после успешного входа
+func (guard *AuthGuard) Success(login string, ip string) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	delete(guard.accounts, accountKey(login))
+	if failures, ok := guard.ips[ip]; ok && !failures.lockedUntil.After(guard.now()) {
+		delete(guard.ips, ip)
+	}
+}
+
+// Unlock снимает блокировку аккаунта; false, если аккаунт не был заблокирован
+func (guard *AuthGuard) Unlock(login string) bool {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	failures, ok := guard.accounts[accountKey(login)]
+	delete(guard.accounts, accountKey(login))
+	return ok && failures.lockedUntil.After(guard.now())
+}
+
+func accountKey(login string) string {
+	return strings.ToLower(login)
+}
+
+func (guard *AuthGuard) Cleanup(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			guard.forget()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (guard *AuthGuard) forget() {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	now := guard.now()
+	for _, table := range []map[string]*authFailures{guard.accounts, guard.ips} {
+		for key, failures := range table {
+			if !failures.lockedUntil.After(now) && now.Sub(failures.lastFailure) > guard.failureWindow {
+				delete(table, key)
+			}
+		}
+	}
+}
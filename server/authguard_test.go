@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock - управляемое время для AuthGuard
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+func newTestGuard() (*AuthGuard, *fakeClock) {
+	config := DefaultConfig()
+	config.AuthFailureBaseDelay = 100 * time.Millisecond
+	config.AuthFailureMaxDelay = time.Second
+	config.AuthFailureWindow = 10 * time.Minute
+	config.AccountLockoutThreshold = 3
+	config.IPLockoutThreshold = 100
+	config.LockoutDuration = 15 * time.Minute
+	guard := NewAuthGuard(config)
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	guard.now = clock.Now
+	return guard, clock
+}
+
+func TestAuthGuardLocksAfterThreshold(t *testing.T) {
+	guard, clock := newTestGuard()
+
+	for i := 1; i < 3; i++ {
+		if _, locked := guard.Failure("alice", "10.0.0.1"); locked {
+			t.Fatalf("failure %d: locked before threshold", i)
+		}
+	}
+	if locked, _ := guard.Locked("alice", "10.0.0.1"); locked {
+		t.Fatal("locked before threshold")
+	}
+	if _, locked := guard.Failure("alice", "10.0.0.1"); !locked {
+		t.Fatal("not locked at threshold")
+	}
+	locked, until := guard.Locked("alice", "10.0.0.2")
+	if !locked || !until.Equal(clock.now.Add(15*time.Minute)) {
+		t.Fatalf("Locked = %v, %v; want lock for 15m from any address", locked, until)
+	}
+
+	clock.Advance(15*time.Minute + time.Second)
+	if locked, _ := guard.Locked("alice", "10.0.0.1"); locked {
+		t.Fatal("still locked after lockout duration")
+	}
+}
+
+func TestAuthGuardBackoff(t *testing.T) {
+	guard, _ := newTestGuard()
+	guard.accountThreshold = 0
+
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		delay, _ := guard.Failure("alice", "10.0.0.1")
+		if delay != w*time.Millisecond {
+			t.Fatalf("failure %d: delay %v, want %v", i+1, delay, w*time.Millisecond)
+		}
+	}
+}
+
+func TestAuthGuardFailureWindow(t *testing.T) {
+	guard, clock := newTestGuard()
+
+	guard.Failure("alice", "10.0.0.1")
+	guard.Failure("alice", "10.0.0.1")
+	clock.Advance(11 * time.Minute)
+	// старые неудачи вышли за окно, счет начинается заново
+	if delay, locked := guard.Failure("alice", "10.0.0.1"); locked || delay != 100*time.Millisecond {
+		t.Fatalf("Failure = %v, %v; want reset counter", delay, locked)
+	}
+}
+
+func TestAuthGuardUnlock(t *testing.T) {
+	guard, _ := newTestGuard()
+
+	if guard.Unlock("alice") {
+		t.Fatal("Unlock of not locked account returned true")
+	}
+	for i := 0; i < 3; i++ {
+		guard.Failure("alice", "10.0.0.1")
+	}
+	if !guard.Unlock("alice") {
+		t.Fatal("Unlock of locked account returned false")
+	}
+	if locked, _ := guard.Locked("alice", "10.0.0.1"); locked {
+		t.Fatal("still locked after Unlock")
+	}
+}
+
+func TestAuthGuardIgnoresLoginCase(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []string
+		check    string
+		unlock   string
+	}{
+		{"same case", []string{"alice", "alice", "alice"}, "alice", "alice"},
+		{"mixed case failures", []string{"Alice", "ALICE", "alice"}, "aLiCe", "ALICE"},
+		{"upper case check", []string{"bob", "bob", "bob"}, "BOB", "Bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard, _ := newTestGuard()
+			for _, login := range tt.failures {
+				guard.Failure(login, "10.0.0.1")
+			}
+			if locked, _ := guard.Locked(tt.check, "10.0.0.2"); !locked {
+				t.Fatalf("%s is not locked after failures %v", tt.check, tt.failures)
+			}
+			if !guard.Unlock(tt.unlock) {
+				t.Fatalf("Unlock(%s) did not find the lock", tt.unlock)
+			}
+			if locked, _ := guard.Locked(tt.check, "10.0.0.2"); locked {
+				t.Fatalf("%s is still locked after Unlock(%s)", tt.check, tt.unlock)
+			}
+		})
+	}
+}
+
+func TestAuthGuardSuccessResetsAccount(t *testing.T) {
+	guard, _ := newTestGuard()
+
+	guard.Failure("Alice", "10.0.0.1")
+	guard.Failure("Alice", "10.0.0.1")
+	guard.Success("alice", "10.0.0.1")
+	if _, locked := guard.Failure("ALICE", "10.0.0.1"); locked {
+		t.Fatal("Success did not reset failures for another case of the login")
+	}
+}
@@ -0,0 +1,70 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store хранит содержимое вложений по ключу; ключи выдает NewKey
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type Config struct {
+	// "local" или "s3"
+	Kind string
+	// каталог для Kind == "local"
+	Dir string
+
+	// S3-совместимое хранилище, например MinIO
+	S3Endpoint  string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL    bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Kind:       "local",
+		Dir:        "attachments",
+		S3Endpoint: "localhost:9000",
+		S3Bucket:   "chat-attachments",
+	}
+}
+
+// New создает хранилище по конфигурации
+func New(ctx context.Context, config Config) (Store, error) {
+	switch config.Kind {
+	case "", "local":
+		return NewLocal(config.Dir)
+	case "s3":
+		return NewS3(ctx, config)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", config.Kind)
+	}
+}
+
+// NewKey возвращает случайный ключ; в нем только hex символы, поэтому он
+// безопасен и как имя файла, и как имя объекта
+func NewKey() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func validKey(key string) bool {
+	if len(key) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
@@ -0,0 +1,64 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 хранит вложения в бакете S3-совместимого хранилища
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 подключается к хранилищу и создает бакет, если его еще нет
+func NewS3(ctx context.Context, config Config) (*S3, error) {
+	client, err := minio.New(config.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
+		Secure: config.S3UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(ctx, config.S3Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, config.S3Bucket, minio.MakeBucketOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &S3{client: client, bucket: config.S3Bucket}, nil
+}
+
+func (store *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := store.client.PutObject(ctx, store.bucket, key, r, size,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Get проверяет наличие объекта сразу, а не при первом чтении, как это делает minio
+func (store *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := store.client.GetObject(ctx, store.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (store *S3) Delete(ctx context.Context, key string) error {
+	return store.client.RemoveObject(ctx, store.bucket, key, minio.RemoveObjectOptions{})
+}
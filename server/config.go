@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"server/blobstore"
+	"server/database"
+	"server/logging"
+	"server/moderation"
+	"server/validation"
+	"time"
+)
+
+type Config struct {
+	// каталог с логами; каждая компонента пишет в свой файл
+	LogDir string
+	Log    logging.Config
+
+	// адрес служебного HTTP сервера с /metrics; пустая строка - не запускать
+	HTTPAddr string
+	// как часто и с каким таймаутом проверять базу и kafka для /readyz
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// ограничения частоты; значение 0 в поле "в секунду" отключает ограничение
+	MessagesPerSecond          float64
+	MessagesBurst              int
+	TypingPerSecond            float64
+	TypingBurst                int
+	ConnectionsPerSecondPerIP  float64
+	ConnectionsBurstPerIP      int
+	MaxConnectionsPerIP        int
+	AuthAttemptsPerSecondPerIP float64
+	AuthAttemptsBurstPerIP     int
+
+	// защита от подбора пароля: задержка ответа растет вдвое с каждой неудачей,
+	// после порога аккаунт или адрес блокируется на LockoutDuration
+	AuthFailureBaseDelay    time.Duration
+	AuthFailureMaxDelay     time.Duration
+	AuthFailureWindow       time.Duration
+	AccountLockoutThreshold int
+	IPLockoutThreshold      int
+	LockoutDuration         time.Duration
+	// что делать с перепиской при удалении аккаунта: database.DeletePolicyAnonymize
+	// или database.DeletePolicyCascade
+	AccountDeletePolicy string
+	// токен для служебных команд в HTTP сервере; пустой - команды отключены
+	AdminToken string
+
+	// максимальная длина сообщения в символах
+	MaxMessageLength int
+	// сколько клиент показывает "печатает", если следующего события не пришло
+	TypingTTL time.Duration
+
+	// фильтры сообщений перед сохранением
+	Moderation moderation.Config
+
+	// хранилище вложений и ограничения на загрузку
+	Blob blobstore.Config
+	// максимальный размер файла и аватара в байтах
+	MaxAttachmentSize int64
+	MaxAvatarSize     int64
+	// максимальный размер куска upload_chunk до base64
+	MaxChunkSize int
+	// сколько загрузок может быть открыто одновременно на одном соединении
+	MaxUploadsPerConnection int
+
+	// куда отправлять трейсы: "none", "stdout" или "otlp"
+	TraceExporter    string
+	OTLPEndpoint     string
+	OTLPInsecure     bool
+	TraceSampleRatio float64
+
+	// размер очереди исходящих сообщений на одно соединение
+	SendQueueSize int
+	// сколько ждать записи в сокет, прежде чем считать клиента отвалившимся
+	WriteTimeout time.Duration
+	// что делать, если клиент не успевает читать
+	OverflowPolicy OverflowPolicy
+	// сколько кадров OverflowSpill держит в памяти, прежде чем закрыть соединение
+	// и перенести их в офлайн очередь
+	MaxSpill int
+
+	// соединение закрывается, если от клиента ничего не приходило дольше IdleTimeout
+	IdleTimeout time.Duration
+	// как часто сервер пингует авторизованных клиентов
+	HeartbeatInterval time.Duration
+	// максимальный размер входящего кадра в байтах; клиент, приславший больше, отключается
+	MaxFrameSize int
+
+	// сколько ждать завершения обработчиков соединений при остановке
+	ShutdownTimeout time.Duration
+	// сколько ждать доставки накопленных сообщений в kafka при остановке
+	KafkaFlushTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		LogDir: "logs",
+		Log:    logging.DefaultConfig(),
+
+		HTTPAddr:            "localhost:2112",
+		HealthCheckInterval: 5 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+
+		MessagesPerSecond:          5,
+		MessagesBurst:              20,
+		TypingPerSecond:            0.5,
+		TypingBurst:                3,
+		ConnectionsPerSecondPerIP:  1,
+		ConnectionsBurstPerIP:      10,
+		MaxConnectionsPerIP:        20,
+		AuthAttemptsPerSecondPerIP: 0.2,
+		AuthAttemptsBurstPerIP:     5,
+
+		AuthFailureBaseDelay:    500 * time.Millisecond,
+		AuthFailureMaxDelay:     8 * time.Second,
+		AuthFailureWindow:       15 * time.Minute,
+		AccountLockoutThreshold: 5,
+		IPLockoutThreshold:      20,
+		LockoutDuration:         15 * time.Minute,
+		AccountDeletePolicy:     database.DeletePolicyAnonymize,
+
+		MaxMessageLength: validation.DefaultMaxMessageLength,
+		TypingTTL:        6 * time.Second,
+
+		Blob:                    blobstore.DefaultConfig(),
+		MaxAttachmentSize:       20 << 20,
+		MaxAvatarSize:           1 << 20,
+		MaxChunkSize:            64 << 10,
+		MaxUploadsPerConnection: 2,
+
+		TraceExporter:    "none",
+		OTLPEndpoint:     "localhost:4318",
+		OTLPInsecure:     true,
+		TraceSampleRatio: 1,
+
+		SendQueueSize:  256,
+		WriteTimeout:   10 * time.Second,
+		OverflowPolicy: OverflowDropOldest,
+		MaxSpill:       4096,
+
+		IdleTimeout:       90 * time.Second,
+		HeartbeatInterval: 30 * time.Second,
+		MaxFrameSize:      256 << 10,
+
+		ShutdownTimeout:   10 * time.Second,
+		KafkaFlushTimeout: 5 * time.Second,
+	}
+}
+
+// LoadConfig собирает конфигурацию из значений по умолчанию и флагов командной строки args
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	var rulesPath string
+	fs.StringVar(&rulesPath, "moderation-rules", "", "JSON file with content filter rules")
+	config.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	if rulesPath != "" {
+		rules, err := moderation.LoadRules(rulesPath)
+		if err != nil {
+			return config, err
+		}
+		config.Moderation.Rules = rules
+	}
+	return config, nil
+}
+
+func (config *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.LogDir, "log-dir", config.LogDir, "directory for component log files")
+	fs.TextVar(&config.Log.Level, "log-level", config.Log.Level, "minimum log level: debug, info, warn or error")
+	fs.BoolVar(&config.Log.JSON, "log-json", config.Log.JSON, "write log records as JSON")
+	fs.Int64Var(&config.Log.MaxSize, "log-max-size", config.Log.MaxSize, "rotate a log file after this many bytes, 0 - never")
+	fs.DurationVar(&config.Log.MaxAge, "log-max-age", config.Log.MaxAge, "rotate a log file after this age, 0 - never")
+	fs.IntVar(&config.Log.MaxBackups, "log-max-backups", config.Log.MaxBackups, "rotated log files to keep, 0 - all")
+
+	fs.StringVar(&config.HTTPAddr, "http-addr", config.HTTPAddr, "address of the HTTP server with metrics and health checks, empty - disabled")
+	// токен лучше передавать через окружение, чтобы он не был виден в списке процессов
+	fs.StringVar(&config.AdminToken, "admin-token", envOr("GOCHAT_ADMIN_TOKEN", config.AdminToken),
+		"bearer token for /admin/* HTTP commands, empty - disabled (env GOCHAT_ADMIN_TOKEN)")
+	fs.StringVar(&config.AccountDeletePolicy, "account-delete-policy", config.AccountDeletePolicy, "anonymize or cascade")
+
+	fs.Float64Var(&config.MessagesPerSecond, "messages-per-second", config.MessagesPerSecond, "messages per user per second, 0 - unlimited")
+	fs.IntVar(&config.MessagesBurst, "messages-burst", config.MessagesBurst, "message burst per user")
+	fs.Float64Var(&config.TypingPerSecond, "typing-per-second", config.TypingPerSecond, "typing events per user per second, 0 - unlimited")
+	fs.IntVar(&config.TypingBurst, "typing-burst", config.TypingBurst, "typing event burst per user")
+	fs.Float64Var(&config.ConnectionsPerSecondPerIP, "connections-per-second-per-ip", config.ConnectionsPerSecondPerIP, "new connections per IP per second, 0 - unlimited")
+	fs.IntVar(&config.ConnectionsBurstPerIP, "connections-burst-per-ip", config.ConnectionsBurstPerIP, "new connection burst per IP")
+	fs.IntVar(&config.MaxConnectionsPerIP, "max-connections-per-ip", config.MaxConnectionsPerIP, "open connections per IP, 0 - unlimited")
+	fs.Float64Var(&config.AuthAttemptsPerSecondPerIP, "auth-attempts-per-second-per-ip", config.AuthAttemptsPerSecondPerIP, "login attempts per IP per second, 0 - unlimited")
+	fs.IntVar(&config.AuthAttemptsBurstPerIP, "auth-attempts-burst-per-ip", config.AuthAttemptsBurstPerIP, "login attempt burst per IP")
+
+	fs.DurationVar(&config.AuthFailureBaseDelay, "auth-failure-base-delay", config.AuthFailureBaseDelay, "delay after the first failed login")
+	fs.DurationVar(&config.AuthFailureMaxDelay, "auth-failure-max-delay", config.AuthFailureMaxDelay, "maximum delay after failed logins")
+	fs.DurationVar(&config.AuthFailureWindow, "auth-failure-window", config.AuthFailureWindow, "window for counting failed logins")
+	fs.IntVar(&config.AccountLockoutThreshold, "account-lockout-threshold", config.AccountLockoutThreshold, "failed logins before an account is locked")
+	fs.IntVar(&config.IPLockoutThreshold, "ip-lockout-threshold", config.IPLockoutThreshold, "failed logins before an IP is locked")
+	fs.DurationVar(&config.LockoutDuration, "lockout-duration", config.LockoutDuration, "how long a lockout lasts")
+
+	fs.IntVar(&config.MaxMessageLength, "max-message-length", config.MaxMessageLength, "maximum message length in characters")
+
+	fs.StringVar(&config.TraceExporter, "trace-exporter", config.TraceExporter, "trace exporter: none, stdout or otlp")
+	fs.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "OTLP HTTP endpoint")
+	fs.BoolVar(&config.OTLPInsecure, "otlp-insecure", config.OTLPInsecure, "send traces to the OTLP endpoint without TLS")
+	fs.Float64Var(&config.TraceSampleRatio, "trace-sample-ratio", config.TraceSampleRatio, "share of traces to sample, 0..1")
+
+	fs.IntVar(&config.SendQueueSize, "send-queue-size", config.SendQueueSize, "outbound frames queued per connection")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "socket write timeout")
+	fs.Var(&config.OverflowPolicy, "overflow-policy", "what to do when a send queue is full: drop_oldest, disconnect or spill")
+	fs.IntVar(&config.MaxSpill, "max-spill", config.MaxSpill, "overflow frames kept per connection")
+
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "close connections silent for this long, 0 - never")
+	fs.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", config.HeartbeatInterval, "ping interval, 0 - no pings")
+	fs.IntVar(&config.MaxFrameSize, "max-frame-size", config.MaxFrameSize, "maximum inbound frame size in bytes, 0 - unlimited")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "how long to wait for connections on shutdown")
+	fs.DurationVar(&config.KafkaFlushTimeout, "kafka-flush-timeout", config.KafkaFlushTimeout, "how long to wait for Kafka on shutdown")
+}
+
+func envOr(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
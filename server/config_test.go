@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFlags(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rules, []byte(`[{"name": "spam", "words": ["casino"], "action": "reject"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig([]string{
+		"-trace-exporter", "stdout",
+		"-overflow-policy", "disconnect",
+		"-idle-timeout", "2m",
+		"-log-json",
+		"-moderation-rules", rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TraceExporter != "stdout" {
+		t.Errorf("TraceExporter = %q, want stdout", config.TraceExporter)
+	}
+	if config.OverflowPolicy != OverflowDisconnect {
+		t.Errorf("OverflowPolicy = %v, want disconnect", config.OverflowPolicy)
+	}
+	if config.IdleTimeout != 2*time.Minute {
+		t.Errorf("IdleTimeout = %v, want 2m", config.IdleTimeout)
+	}
+	if !config.Log.JSON {
+		t.Error("Log.JSON = false, want true")
+	}
+	if len(config.Moderation.Rules) != 1 || config.Moderation.Rules[0].Name != "spam" {
+		t.Errorf("Moderation.Rules = %+v, want the spam rule", config.Moderation.Rules)
+	}
+	// не заданные флагом значения остаются по умолчанию
+	if config.SendQueueSize != DefaultConfig().SendQueueSize {
+		t.Errorf("SendQueueSize = %d, want default", config.SendQueueSize)
+	}
+}
+
+func TestLoadConfigAdminTokenFromEnv(t *testing.T) {
+	t.Setenv("GOCHAT_ADMIN_TOKEN", "secret")
+	config, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AdminToken != "secret" {
+		t.Errorf("AdminToken = %q, want the value from env", config.AdminToken)
+	}
+}
+
+func TestLoadConfigRejectsBadValues(t *testing.T) {
+	for _, args := range [][]string{
+		{"-overflow-policy", "never"},
+		{"-moderation-rules", filepath.Join(t.TempDir(), "missing.json")},
+	} {
+		if _, err := LoadConfig(args); err == nil {
+			t.Errorf("LoadConfig(%q) succeeded, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"server/handlers"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OverflowPolicy int
+
+const (
+	// выкидываем самое старое сообщение из очереди
+	OverflowDropOldest OverflowPolicy = iota
+	// закрываем соединение медленного клиента
+	OverflowDisconnect
+	// складываем лишнее в буфер соединения, он досылается по мере освобождения очереди;
+	// то, что не успели отправить до закрытия, сервер переносит в офлайн очередь пользователя
+	OverflowSpill
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowSpill:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// Set разбирает политику по имени; нужен, чтобы задавать ее флагом
+func (policy *OverflowPolicy) Set(s string) error {
+	for _, p := range []OverflowPolicy{OverflowDropOldest, OverflowDisconnect, OverflowSpill} {
+		if p.String() == s {
+			*policy = p
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", s)
+}
+
+var (
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrSlowConsumer     = errors.New("slow consumer")
+	ErrFrameTooLarge    = errors.New("frame too large")
+)
+
+// readFrame читает из reader кадр до '\n' включительно, не больше limit байт; 0 - без ограничения.
+// Кадр собирается по кускам буфера reader, поэтому лишнее не копится в памяти
+func readFrame(reader *bufio.Reader, limit int) ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if limit > 0 && len(frame)+len(chunk) > limit {
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, chunk...)
+		if err != bufio.ErrBufferFull {
+			return frame, err
+		}
+	}
+}
+
+// QueueStats - общие для сервера счетчики переполнений очередей отправки
+type QueueStats struct {
+	Dropped      atomic.Int64
+	Spilled      atomic.Int64
+	Disconnected atomic.Int64
+	Persisted    atomic.Int64
+}
+
+type Connection struct {
+	conn   net.Conn
+	id     int64
+	userId int
+	// аккаунт пользователя удален; меняется под server.mutex
+	accountDeleted bool
+
+	queue        chan []byte
+	policy       OverflowPolicy
+	writeTimeout time.Duration
+
+	// буфер для OverflowSpill; после закрытия его вместе с очередью забирает Unsent
+	spill      [][]byte
+	maxSpill   int
+	spillMutex sync.Mutex
+
+	dropped atomic.Int64
+	stats   *QueueStats
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConnection(conn net.Conn, id int64, config Config, stats *QueueStats) *Connection {
+	connection := &Connection{
+		conn:         conn,
+		id:           id,
+		queue:        make(chan []byte, config.SendQueueSize),
+		policy:       config.OverflowPolicy,
+		writeTimeout: config.WriteTimeout,
+		maxSpill:     config.MaxSpill,
+		stats:        stats,
+		closed:       make(chan struct{}),
+	}
+	go connection.writeLoop()
+	return connection
+}
+
+// Send кладет сообщение в очередь отправки и никогда не блокируется на записи в сокет
+func (c *Connection) Send(data interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(append(jsonData, '\n'))
+}
+
+// SendWait ждет места в очереди вместо применения политики переполнения;
+// нужен для потоков, которые сами обслуживают соединение, например при отправке истории
+func (c *Connection) SendWait(data interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var timeout <-chan time.Time
+	if c.writeTimeout > 0 {
+		timer := time.NewTimer(c.writeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.queue <- append(jsonData, '\n'):
+		return nil
+	case <-c.closed:
+		return ErrConnectionClosed
+	case <-timeout:
+		c.stats.Disconnected.Add(1)
+		c.Close()
+		return ErrSlowConsumer
+	}
+}
+
+// CloseAfterFlush закрывает соединение после отправки всего, что уже стоит в очереди;
+// если очередь не освобождается за writeTimeout, соединение закрывается сразу
+func (c *Connection) CloseAfterFlush() {
+	c.spillMutex.Lock()
+	if len(c.spill) > 0 {
+		c.spill = append(c.spill, nil)
+		c.spillMutex.Unlock()
+		return
+	}
+	// ждем без блокировки, иначе writeLoop не сможет дозаполнить очередь из буфера
+	c.spillMutex.Unlock()
+
+	var timeout <-chan time.Time
+	if c.writeTimeout > 0 {
+		timer := time.NewTimer(c.writeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.queue <- nil:
+	case <-c.closed:
+	case <-timeout:
+		c.stats.Disconnected.Add(1)
+		c.Close()
+	}
+}
+
+func (c *Connection) enqueue(frame []byte) error {
+	if c.policy == OverflowSpill {
+		return c.enqueueSpill(frame)
+	}
+
+	for {
+		select {
+		case <-c.closed:
+			return ErrConnectionClosed
+		default:
+		}
+
+		select {
+		case c.queue <- frame:
+			return nil
+		default:
+		}
+
+		if c.policy == OverflowDisconnect {
+			c.stats.Disconnected.Add(1)
+			c.Close()
+			return ErrSlowConsumer
+		}
+
+		select {
+		case <-c.queue:
+			c.dropped.Add(1)
+			c.stats.Dropped.Add(1)
+		default:
+		}
+	}
+}
+
+func (c *Connection) enqueueSpill(frame []byte) error {
+	c.spillMutex.Lock()
+	defer c.spillMutex.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrConnectionClosed
+	default:
+	}
+
+	// пока буфер не пуст, пишем в него, чтобы не нарушить порядок
+	if len(c.spill) == 0 {
+		select {
+		case c.queue <- frame:
+			return nil
+		default:
+		}
+	}
+	// кадр, переполнивший буфер, не теряется: он уйдет в офлайн очередь вместе с остальными
+	c.spill = append(c.spill, frame)
+	c.stats.Spilled.Add(1)
+	if len(c.spill) > c.maxSpill {
+		c.stats.Disconnected.Add(1)
+		c.Close()
+		return ErrSlowConsumer
+	}
+	return nil
+}
+
+// Unsent забирает кадры, которые закрытое соединение не успело отправить, без '\n' в конце
+func (c *Connection) Unsent() [][]byte {
+	c.spillMutex.Lock()
+	defer c.spillMutex.Unlock()
+	var frames [][]byte
+	for {
+		select {
+		case frame := <-c.queue:
+			frames = append(frames, frame)
+			continue
+		default:
+		}
+		break
+	}
+	frames = append(frames, c.spill...)
+	c.spill = nil
+
+	unsent := frames[:0]
+	for _, frame := range frames {
+		// nil - метка из CloseAfterFlush
+		if frame != nil {
+			unsent = append(unsent, bytes.TrimSuffix(frame, []byte("\n")))
+		}
+	}
+	return unsent
+}
+
+func (c *Connection) refillFromSpill() {
+	c.spillMutex.Lock()
+	defer c.spillMutex.Unlock()
+	for len(c.spill) > 0 {
+		select {
+		case c.queue <- c.spill[0]:
+			c.spill[0] = nil
+			c.spill = c.spill[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case frame := <-c.queue:
+			// nil в очереди - метка из CloseAfterFlush
+			if frame == nil {
+				c.Close()
+				return
+			}
+			if c.writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
+			if _, err := c.conn.Write(frame); err != nil {
+				c.Close()
+				return
+			}
+			if c.policy == OverflowSpill {
+				c.refillFromSpill()
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Done закрывается вместе с соединением
+func (c *Connection) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Heartbeat пингует клиента каждые interval, пока соединение открыто
+func (c *Connection) Heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Send(handlers.Msg{Type: handlers.TypePing, Timestamp: time.Now().UnixMilli()}); err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// SetIdleDeadline откладывает закрытие соединения по бездействию
+func (c *Connection) SetIdleDeadline(timeout time.Duration) {
+	if timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// QueueDepth - сколько кадров ждут отправки, включая буфер OverflowSpill
+func (c *Connection) QueueDepth() int {
+	c.spillMutex.Lock()
+	defer c.spillMutex.Unlock()
+	return len(c.queue) + len(c.spill)
+}
+
+func (c *Connection) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
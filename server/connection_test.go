@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConnection - соединение поверх net.Pipe; клиентский конец никто не читает,
+// пока тест не вызовет readFrames, поэтому первый кадр застревает в Write
+func newTestConnection(t *testing.T, policy OverflowPolicy, queueSize int, maxSpill int) (*Connection, net.Conn, *QueueStats) {
+	t.Helper()
+	server, client := net.Pipe()
+	config := DefaultConfig()
+	config.OverflowPolicy = policy
+	config.SendQueueSize = queueSize
+	config.MaxSpill = maxSpill
+	config.WriteTimeout = 0
+	stats := &QueueStats{}
+	connection := NewConnection(server, 1, config, stats)
+	t.Cleanup(func() {
+		connection.Close()
+		client.Close()
+	})
+	return connection, client, stats
+}
+
+// sendBlocked отправляет кадр 0 и ждет, пока writeLoop заберет его из очереди и встанет на записи
+func sendBlocked(t *testing.T, connection *Connection) {
+	t.Helper()
+	if err := connection.Send(0); err != nil {
+		t.Fatalf("send 0: %v", err)
+	}
+	waitFor(t, func() bool { return connection.QueueDepth() == 0 })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readFrames читает n кадров с клиентского конца
+func readFrames(t *testing.T, client net.Conn, n int) []int {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+	frames := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read frame %d: %v", i, err)
+		}
+		frame, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			t.Fatalf("bad frame %q: %v", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func equalFrames(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isClosed(connection *Connection) bool {
+	select {
+	case <-connection.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestConnectionDropOldest(t *testing.T) {
+	connection, client, stats := newTestConnection(t, OverflowDropOldest, 2, 0)
+	sendBlocked(t, connection)
+
+	for i := 1; i <= 4; i++ {
+		if err := connection.Send(i); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if got := connection.Dropped(); got != 2 {
+		t.Errorf("connection dropped = %d, want 2", got)
+	}
+	if got := stats.Dropped.Load(); got != 2 {
+		t.Errorf("stats dropped = %d, want 2", got)
+	}
+	if got := readFrames(t, client, 3); !equalFrames(got, []int{0, 3, 4}) {
+		t.Errorf("frames = %v, want [0 3 4]", got)
+	}
+	if stats.Spilled.Load() != 0 || stats.Disconnected.Load() != 0 {
+		t.Errorf("unexpected stats: spilled %d, disconnected %d", stats.Spilled.Load(), stats.Disconnected.Load())
+	}
+}
+
+func TestConnectionDisconnect(t *testing.T) {
+	connection, _, stats := newTestConnection(t, OverflowDisconnect, 1, 0)
+	sendBlocked(t, connection)
+
+	if err := connection.Send(1); err != nil {
+		t.Fatalf("send 1: %v", err)
+	}
+	if err := connection.Send(2); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("send 2: error = %v, want ErrSlowConsumer", err)
+	}
+	if !isClosed(connection) {
+		t.Error("connection is still open after overflow")
+	}
+	if err := connection.Send(3); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("send after close: error = %v, want ErrConnectionClosed", err)
+	}
+	if got := stats.Disconnected.Load(); got != 1 {
+		t.Errorf("stats disconnected = %d, want 1", got)
+	}
+	if stats.Dropped.Load() != 0 || stats.Spilled.Load() != 0 {
+		t.Errorf("unexpected stats: dropped %d, spilled %d", stats.Dropped.Load(), stats.Spilled.Load())
+	}
+}
+
+func TestConnectionSpillKeepsOrder(t *testing.T) {
+	connection, client, stats := newTestConnection(t, OverflowSpill, 1, 4)
+	sendBlocked(t, connection)
+
+	for i := 1; i <= 4; i++ {
+		if err := connection.Send(i); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if got := connection.QueueDepth(); got != 4 {
+		t.Errorf("queue depth = %d, want 4", got)
+	}
+	if got := stats.Spilled.Load(); got != 3 {
+		t.Errorf("stats spilled = %d, want 3", got)
+	}
+	if got := readFrames(t, client, 5); !equalFrames(got, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("frames = %v, want [0 1 2 3 4]", got)
+	}
+	if stats.Dropped.Load() != 0 || stats.Disconnected.Load() != 0 {
+		t.Errorf("unexpected stats: dropped %d, disconnected %d", stats.Dropped.Load(), stats.Disconnected.Load())
+	}
+}
+
+func TestConnectionSpillOverflow(t *testing.T) {
+	connection, _, stats := newTestConnection(t, OverflowSpill, 1, 2)
+	sendBlocked(t, connection)
+
+	for i := 1; i <= 3; i++ {
+		if err := connection.Send(i); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := connection.Send(4); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("send 4: error = %v, want ErrSlowConsumer", err)
+	}
+	if !isClosed(connection) {
+		t.Error("connection is still open after spill overflow")
+	}
+	if got := stats.Spilled.Load(); got != 3 {
+		t.Errorf("stats spilled = %d, want 3", got)
+	}
+	if got := stats.Disconnected.Load(); got != 1 {
+		t.Errorf("stats disconnected = %d, want 1", got)
+	}
+
+	// все неотправленные кадры, включая переполнивший буфер, достаются офлайн очереди
+	var unsent []int
+	for _, frame := range connection.Unsent() {
+		n, err := strconv.Atoi(string(frame))
+		if err != nil {
+			t.Fatalf("bad frame %q: %v", frame, err)
+		}
+		unsent = append(unsent, n)
+	}
+	if !equalFrames(unsent, []int{1, 2, 3, 4}) {
+		t.Errorf("unsent = %v, want [1 2 3 4]", unsent)
+	}
+	if got := connection.QueueDepth(); got != 0 {
+		t.Errorf("queue depth after Unsent = %d, want 0", got)
+	}
+}
+
+func TestConnectionCloseAfterFlush(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy OverflowPolicy
+		sends  int
+	}{
+		{"drop_oldest", OverflowDropOldest, 2},
+		{"spill", OverflowSpill, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection, client, _ := newTestConnection(t, test.policy, 2, 4)
+			sendBlocked(t, connection)
+			for i := 1; i <= test.sends; i++ {
+				if err := connection.Send(i); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+			}
+
+			go connection.CloseAfterFlush()
+			want := make([]int, 0, test.sends+1)
+			for i := 0; i <= test.sends; i++ {
+				want = append(want, i)
+			}
+			if got := readFrames(t, client, test.sends+1); !equalFrames(got, want) {
+				t.Errorf("frames = %v, want %v", got, want)
+			}
+			waitFor(t, func() bool { return isClosed(connection) })
+		})
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	// буфер reader меньше кадра, чтобы кадр собирался из нескольких кусков
+	reader := bufio.NewReaderSize(strings.NewReader("0123456789abcdef0123\nok\n"+strings.Repeat("x", 40)+"\n"), 16)
+
+	frame, err := readFrame(reader, 32)
+	if err != nil || string(frame) != "0123456789abcdef0123\n" {
+		t.Fatalf("frame = %q, %v; want the first line", frame, err)
+	}
+	frame, err = readFrame(reader, 32)
+	if err != nil || string(frame) != "ok\n" {
+		t.Fatalf("frame = %q, %v; want ok", frame, err)
+	}
+	if _, err = readFrame(reader, 32); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("error = %v, want ErrFrameTooLarge", err)
+	}
+}
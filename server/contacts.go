@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"server/database"
+	"server/handlers"
+)
+
+func validPrivacy(setting string) bool {
+	switch setting {
+	case handlers.PrivacyEveryone, handlers.PrivacyContacts, handlers.PrivacyNobody:
+		return true
+	}
+	return false
+}
+
+// contacts меняет контакты, черный список или настройки приватности и отвечает
+// их новым состоянием
+func (server *Server) contacts(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if msg.Type == handlers.TypePrivacy {
+		server.privacy(connection, user, msg)
+		return
+	}
+
+	var err error
+	if msg.Type != handlers.TypeContacts {
+		var target *handlers.User
+		target, err = database.GetUserByLogin(server.DB, msg.Receiver)
+		if err == nil {
+			switch msg.Type {
+			case handlers.TypeContactAdd:
+				err = database.AddContact(server.DB, user.Id, target.Id)
+			case handlers.TypeContactRemove:
+				err = database.RemoveContact(server.DB, user.Id, target.Id)
+			case handlers.TypeBlock:
+				err = database.Block(server.DB, user.Id, target.Id)
+			case handlers.TypeUnblock:
+				err = database.Unblock(server.DB, user.Id, target.Id)
+			}
+		}
+		if err == nil {
+			server.logger.Info("contacts changed", "user", user.Login, "action", msg.Type, "target", target.Login)
+		}
+	}
+	if err == sql.ErrNoRows {
+		connection.Send(handlers.Msg{Type: handlers.TypeError, Receiver: msg.Receiver, Timestamp: time.Now().UnixMilli(),
+			Text: "user not found", Status: 1, Code: "user_not_found"})
+		return
+	}
+
+	var contacts, blocked []string
+	if err == nil {
+		contacts, blocked, err = database.GetContacts(server.DB, user.Id)
+	}
+	if err != nil {
+		server.logger.Error("contacts", "user", user.Login, "action", msg.Type, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypeContacts,
+		Receiver:  user.Login,
+		Timestamp: time.Now().UnixMilli(),
+		Contacts:  contacts,
+		Blocked:   blocked,
+	})
+}
+
+// privacy сохраняет присланные настройки, если они есть, и отвечает текущими; вызывать под server.mutex
+func (server *Server) privacy(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	var err error
+	if msg.Privacy != nil {
+		err = database.SetPrivacy(server.DB, user.Id, *msg.Privacy)
+		if err == nil {
+			server.logger.Info("privacy changed", "user", user.Login,
+				"messages", msg.Privacy.Messages, "online", msg.Privacy.Online)
+		}
+	}
+	var settings *handlers.PrivacySettings
+	if err == nil {
+		settings, err = database.GetPrivacy(server.DB, user.Id)
+	}
+	if err != nil {
+		server.logger.Error("privacy", "user", user.Login, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypePrivacy,
+		Receiver:  user.Login,
+		Timestamp: time.Now().UnixMilli(),
+		Privacy:   settings,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"server/database"
+	"server/handlers"
+)
+
+// conversations отвечает списком переписок пользователя с числом непрочитанных
+func (server *Server) conversations(connection *Connection, user *handlers.User) {
+	server.mutex.Lock()
+	infos, err := database.GetConversationInfos(server.DB, user.Id)
+	server.mutex.Unlock()
+	if err != nil {
+		server.logger.Error("get conversations", "user", user.Login, "error", err)
+		connection.Send(errorMsg(handlers.Msg{Type: handlers.TypeConversations}, err))
+		return
+	}
+	connection.Send(handlers.Msg{
+		Type:          handlers.TypeConversations,
+		Receiver:      user.Login,
+		Timestamp:     time.Now().UnixMilli(),
+		Conversations: infos,
+	})
+}
+
+// markRead отмечает переписку с msg.Receiver прочитанной до msg.Seq и отвечает
+// обновленной строкой списка переписок
+func (server *Server) markRead(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peer, err := database.GetUserByLogin(server.DB, msg.Receiver)
+	var conversation *handlers.Conversation
+	if err == nil {
+		conversation, err = database.GetConversationBetweenUsers(server.DB, user.Id, peer.Id)
+	}
+	if err == sql.ErrNoRows {
+		// переписки еще нет, отмечать нечего
+		return
+	}
+	if err == nil {
+		err = database.MarkRead(server.DB, user.Id, conversation.ID, msg.Seq)
+	}
+	var info *handlers.ConversationInfo
+	if err == nil {
+		info, err = database.GetConversationInfo(server.DB, user.Id, conversation.ID)
+	}
+	if err != nil {
+		server.logger.Error("mark read", "user", user.Login, "peer", msg.Receiver, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	connection.Send(handlers.Msg{
+		Type:          handlers.TypeRead,
+		Sender:        user.Login,
+		Receiver:      msg.Receiver,
+		Timestamp:     time.Now().UnixMilli(),
+		Seq:           info.LastReadSeq,
+		Conversations: []handlers.ConversationInfo{*info},
+	})
+}
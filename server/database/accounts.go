@@ -0,0 +1,137 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// что делать с перепиской удаляемого аккаунта
+const (
+	// сообщения остаются у собеседников, автор становится deleted_<id>
+	DeletePolicyAnonymize = "anonymize"
+	// аккаунт удаляется вместе со всеми его переписками
+	DeletePolicyCascade = "cascade"
+)
+
+// префикс логина удаленного аккаунта; "_" не проходит проверку логина,
+// поэтому такой логин нельзя ни зарегистрировать, ни указать получателем
+const deletedLoginPrefix = "deleted_"
+
+// IsDeletedLogin - логин анонимизированного удаленного аккаунта
+func IsDeletedLogin(login string) bool {
+	return strings.HasPrefix(login, deletedLoginPrefix)
+}
+
+// код ошибки MySQL при нарушении уникального ключа
+const mysqlDuplicateEntry = 1062
+
+// CheckPassword сверяет хэш пароля с сохраненным; несовпадение - ErrWrongPassword
+func CheckPassword(DB *sql.DB, userID int, hash string) error {
+	defer observe("check_password", time.Now())
+	var stored string
+	err := DB.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if stored == "" || stored != hash {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+func ChangePassword(DB *sql.DB, userID int, hash string) error {
+	defer observe("change_password", time.Now())
+	_, err := DB.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userID)
+	return err
+}
+
+// RenameUser меняет логин; занятый логин, в том числе отличающийся только регистром, - ErrLoginTaken
+func RenameUser(DB *sql.DB, userID int, login string) error {
+	defer observe("rename_user", time.Now())
+	_, err := DB.Exec("UPDATE users SET login = ? WHERE id = ?", login, userID)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrLoginTaken
+	}
+	return err
+}
+
+// DeleteUser удаляет аккаунт по политике policy и возвращает ключи файлов,
+// которые вызывающий должен удалить из хранилища
+func DeleteUser(DB *sql.DB, userID int, policy string) ([]string, error) {
+	defer observe("delete_user", time.Now())
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var avatarKey sql.NullString
+	err = tx.QueryRow("SELECT avatar_key FROM users WHERE id = ? FOR UPDATE", userID).Scan(&avatarKey)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if avatarKey.Valid {
+		keys = append(keys, avatarKey.String)
+	}
+
+	if policy == DeletePolicyCascade {
+		// вложения удаляются каскадом вместе с сообщениями, поэтому ключи собираем заранее
+		rows, err := tx.Query(`SELECT a.blob_key FROM attachments a
+            JOIN messages m ON m.id = a.message_id
+            JOIN conversations c ON c.id = m.conversation_id
+            WHERE c.user1_id = ? OR c.user2_id = ?`, userID, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("DELETE FROM users WHERE id = ?", userID)
+		if err != nil {
+			return nil, err
+		}
+		return keys, tx.Commit()
+	}
+
+	_, err = tx.Exec(`UPDATE users SET login = ?, password = '', online = FALSE, display_name = '', bio = '', timezone = '',
+        avatar_key = NULL, avatar_size = 0, avatar_type = '', avatar_sha256 = '', deleted_at = CURRENT_TIMESTAMP
+        WHERE id = ?`, deletedLoginPrefix+strconv.Itoa(userID), userID)
+	if err != nil {
+		return nil, err
+	}
+	// анонимный аккаунт не должен оставаться ни в чьих контактах и черных списках
+	for _, query := range []string{
+		"DELETE FROM contacts WHERE user_id = ? OR contact_id = ?",
+		"DELETE FROM blocks WHERE user_id = ? OR blocked_id = ?",
+	} {
+		_, err = tx.Exec(query, userID, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, query := range []string{
+		"DELETE FROM privacy_settings WHERE user_id = ?",
+		"DELETE FROM offline_frames WHERE user_id = ?",
+	} {
+		_, err = tx.Exec(query, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, tx.Commit()
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"server/handlers"
+)
+
+// результат действия в admin_audit
+const (
+	AuditOk     = "ok"
+	AuditDenied = "denied"
+	AuditFailed = "failed"
+)
+
+// PermanentBan - срок бессрочной блокировки
+var PermanentBan = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+func AddAdminAudit(DB *sql.DB, actor string, command string, target string, details string, result string) error {
+	defer observe("add_admin_audit", time.Now())
+	_, err := DB.Exec("INSERT INTO admin_audit (actor, command, target, details, result) VALUES (?, ?, ?, ?, ?)",
+		actor, command, target, details, result)
+	return err
+}
+
+// GetRole возвращает текущую роль; роль читается из базы на каждую команду,
+// чтобы ее изменение действовало без переподключения
+func GetRole(DB *sql.DB, userID int) (string, error) {
+	defer observe("get_role", time.Now())
+	var role string
+	err := DB.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	return role, err
+}
+
+func SetRole(DB *sql.DB, userID int, role string) error {
+	defer observe("set_role", time.Now())
+	_, err := DB.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID)
+	return err
+}
+
+func BanUser(DB *sql.DB, userID int, until time.Time, reason string) error {
+	defer observe("ban_user", time.Now())
+	_, err := DB.Exec("UPDATE users SET banned_until = ?, ban_reason = ? WHERE id = ?", until.UTC(), reason, userID)
+	return err
+}
+
+func UnbanUser(DB *sql.DB, userID int) error {
+	defer observe("unban_user", time.Now())
+	_, err := DB.Exec("UPDATE users SET banned_until = NULL, ban_reason = '' WHERE id = ?", userID)
+	return err
+}
+
+// GetOnlineUsers возвращает пользователей с флагом online в порядке логинов
+func GetOnlineUsers(DB *sql.DB) ([]handlers.UserInfo, error) {
+	defer observe("get_online_users", time.Now())
+	rows, err := DB.Query("SELECT login, role FROM users WHERE online = TRUE ORDER BY login")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []handlers.UserInfo
+	for rows.Next() {
+		var user handlers.UserInfo
+		if err := rows.Scan(&user.Login, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// CountRows заполняет в stats число пользователей, переписок и сообщений
+func CountRows(DB *sql.DB, stats *handlers.ServerStats) error {
+	defer observe("count_rows", time.Now())
+	return DB.QueryRow(`SELECT
+        (SELECT COUNT(*) FROM users WHERE deleted_at IS NULL),
+        (SELECT COUNT(*) FROM conversations),
+        (SELECT COUNT(*) FROM messages)`).Scan(&stats.Users, &stats.Conversations, &stats.Messages)
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+const attachmentColumns = "id, blob_key, name, size, content_type, sha256"
+
+func scanAttachment(row scanner) (*handlers.Attachment, error) {
+	var attachment handlers.Attachment
+	err := row.Scan(&attachment.ID, &attachment.Key, &attachment.Name, &attachment.Size,
+		&attachment.ContentType, &attachment.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func insertAttachment(tx *sql.Tx, msgID int, attachment *handlers.Attachment) error {
+	query := "INSERT INTO attachments (message_id, blob_key, name, size, content_type, sha256) VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, msgID, attachment.Key, attachment.Name, attachment.Size, attachment.ContentType, attachment.SHA256)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	attachment.ID = int(id)
+	return nil
+}
+
+// GetParticipantAttachment возвращает вложение, если userID - участник переписки
+// и сообщение с ним не удалено у всех
+func GetParticipantAttachment(DB *sql.DB, attachmentID int, userID int) (*handlers.Attachment, error) {
+	defer observe("get_participant_attachment", time.Now())
+	query := `
+        SELECT a.id, a.blob_key, a.name, a.size, a.content_type, a.sha256
+        FROM attachments a
+        JOIN messages m ON m.id = a.message_id
+        JOIN conversations c ON c.id = m.conversation_id
+        WHERE a.id = ? AND m.deleted_at IS NULL AND (c.user1_id = ? OR c.user2_id = ?)`
+	attachment, err := scanAttachment(DB.QueryRow(query, attachmentID, userID, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoAttachment
+	}
+	return attachment, err
+}
+
+// attachAttachments заполняет вложения у сообщений из переписок userID одним запросом
+func attachAttachments(DB *sql.DB, msgs []handlers.DataBaseMsg, userID int) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	query := `
+        SELECT a.message_id, a.id, a.blob_key, a.name, a.size, a.content_type, a.sha256
+        FROM attachments a
+        JOIN messages m ON m.id = a.message_id
+        WHERE m.conversation_id IN (SELECT id FROM conversations WHERE user1_id = ? OR user2_id = ?)`
+	rows, err := DB.Query(query, userID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[int]int, len(msgs))
+	for i := range msgs {
+		index[msgs[i].ID] = i
+	}
+	for rows.Next() {
+		var msgID int
+		var attachment handlers.Attachment
+		err := rows.Scan(&msgID, &attachment.ID, &attachment.Key, &attachment.Name, &attachment.Size,
+			&attachment.ContentType, &attachment.SHA256)
+		if err != nil {
+			return err
+		}
+		if i, ok := index[msgID]; ok {
+			msgs[i].Attachment = &attachment
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	AuthEventLoginSuccess = "login_success"
+	AuthEventLoginFailed  = "login_failed"
+	AuthEventRegister     = "register"
+	AuthEventLocked       = "locked"
+	AuthEventRejected     = "rejected_locked"
+	AuthEventUnlocked     = "unlocked"
+	AuthEventPassword     = "password_changed"
+	AuthEventRenamed      = "renamed"
+	AuthEventDeleted      = "account_deleted"
+	AuthEventBanned       = "rejected_banned"
+)
+
+func AddAuthEvent(DB *sql.DB, login string, ip string, event string) error {
+	defer observe("add_auth_event", time.Now())
+	_, err := DB.Exec("INSERT INTO auth_events (login, ip, event) VALUES (?, ?, ?)", login, ip, event)
+	return err
+}
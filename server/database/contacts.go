@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+// DefaultPrivacy - настройки пользователя, который их не менял
+var DefaultPrivacy = handlers.PrivacySettings{
+	Messages: handlers.PrivacyEveryone,
+	Online:   handlers.PrivacyEveryone,
+}
+
+func AddContact(DB *sql.DB, userID int, contactID int) error {
+	defer observe("add_contact", time.Now())
+	_, err := DB.Exec("INSERT IGNORE INTO contacts (user_id, contact_id) VALUES (?, ?)", userID, contactID)
+	return err
+}
+
+func RemoveContact(DB *sql.DB, userID int, contactID int) error {
+	defer observe("remove_contact", time.Now())
+	_, err := DB.Exec("DELETE FROM contacts WHERE user_id = ? AND contact_id = ?", userID, contactID)
+	return err
+}
+
+func Block(DB *sql.DB, userID int, blockedID int) error {
+	defer observe("block", time.Now())
+	_, err := DB.Exec("INSERT IGNORE INTO blocks (user_id, blocked_id) VALUES (?, ?)", userID, blockedID)
+	return err
+}
+
+func Unblock(DB *sql.DB, userID int, blockedID int) error {
+	defer observe("unblock", time.Now())
+	_, err := DB.Exec("DELETE FROM blocks WHERE user_id = ? AND blocked_id = ?", userID, blockedID)
+	return err
+}
+
+// GetContacts возвращает логины контактов и заблокированных пользователем
+func GetContacts(DB *sql.DB, userID int) ([]string, []string, error) {
+	defer observe("get_contacts", time.Now())
+	contacts, err := queryLogins(DB, `SELECT u.login FROM contacts c JOIN users u ON u.id = c.contact_id
+        WHERE c.user_id = ? ORDER BY u.login`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocked, err := queryLogins(DB, `SELECT u.login FROM blocks b JOIN users u ON u.id = b.blocked_id
+        WHERE b.user_id = ? ORDER BY u.login`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contacts, blocked, nil
+}
+
+func queryLogins(DB *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var logins []string
+	for rows.Next() {
+		var login string
+		err := rows.Scan(&login)
+		if err != nil {
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+	return logins, rows.Err()
+}
+
+func GetPrivacy(DB *sql.DB, userID int) (*handlers.PrivacySettings, error) {
+	defer observe("get_privacy", time.Now())
+	settings := DefaultPrivacy
+	err := DB.QueryRow("SELECT messages, online FROM privacy_settings WHERE user_id = ?", userID).Scan(
+		&settings.Messages, &settings.Online)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func SetPrivacy(DB *sql.DB, userID int, settings handlers.PrivacySettings) error {
+	defer observe("set_privacy", time.Now())
+	query := `INSERT INTO privacy_settings (user_id, messages, online) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE messages = VALUES(messages), online = VALUES(online)`
+	_, err := DB.Exec(query, userID, settings.Messages, settings.Online)
+	return err
+}
+
+// CanMessage проверяет, что отправитель может писать получателю: никто из них
+// не заблокировал другого и настройки получателя разрешают сообщения от отправителя
+func CanMessage(DB *sql.DB, senderID int, receiverID int) error {
+	defer observe("can_message", time.Now())
+	query := `
+        SELECT
+            EXISTS (SELECT 1 FROM blocks WHERE (user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)),
+            COALESCE((SELECT messages FROM privacy_settings WHERE user_id = ?), ?),
+            EXISTS (SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?)`
+	var blocked, isContact bool
+	var messages string
+	err := DB.QueryRow(query, senderID, receiverID, receiverID, senderID, receiverID, DefaultPrivacy.Messages,
+		receiverID, senderID).Scan(&blocked, &messages, &isContact)
+	if err != nil {
+		return err
+	}
+	if blocked || !allowedBy(messages, isContact) {
+		return ErrNotAllowed
+	}
+	return nil
+}
+
+func allowedBy(setting string, isContact bool) bool {
+	switch setting {
+	case handlers.PrivacyEveryone:
+		return true
+	case handlers.PrivacyContacts:
+		return isContact
+	default:
+		return false
+	}
+}
+
+// onlineVisibleExpr - условие SQL "online виден пользователю ?" для строки users u;
+// ожидает LEFT JOIN privacy_settings p ON p.user_id = u.id и два аргумента с id смотрящего
+const onlineVisibleExpr = `(u.online
+            AND NOT EXISTS (SELECT 1 FROM blocks b WHERE b.user_id = u.id AND b.blocked_id = ?)
+            AND (COALESCE(p.online, 'everyone') = 'everyone'
+                OR (p.online = 'contacts' AND EXISTS (SELECT 1 FROM contacts ct WHERE ct.user_id = u.id AND ct.contact_id = ?))))`
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
@@ -8,24 +9,39 @@ import (
 	"time"
 )
 
+// QueryObserver, если задан, получает имя и длительность каждого запроса
+var QueryObserver func(query string, duration time.Duration)
+
+func observe(query string, start time.Time) {
+	if QueryObserver != nil {
+		QueryObserver(query, time.Since(start))
+	}
+}
+
 func InitDb(dataSourceName string) (*sql.DB, error) {
 	DB, err := sql.Open("mysql", dataSourceName)
 	if err != nil {
 		return nil, err
 	}
-	err = DB.Ping()
+	err = Ping(context.Background(), DB)
 	if err != nil {
 		return nil, err
 	}
 	return DB, nil
 }
 
+func Ping(ctx context.Context, DB *sql.DB) error {
+	return DB.PingContext(ctx)
+}
+
 func CreateUser(DB *sql.DB, user *handlers.User) error {
+	defer observe("create_user", time.Now())
 	_, err := DB.Exec("INSERT INTO users (login, created_at, password) VALUES(?, ?, ?)", user.Login, user.CreatedAt, user.HashPassword)
 	return err
 }
 
 func GetUserById(DB *sql.DB, id int) (*handlers.User, error) {
+	defer observe("get_user_by_id", time.Now())
 	var user handlers.User
 	err := DB.QueryRow("SELECT id, login, created_at, password FROM users WHERE id = ?", id).Scan(
 		&user.Id, &user.Login, &user.CreatedAt, &user.HashPassword)
@@ -36,19 +52,23 @@ func GetUserById(DB *sql.DB, id int) (*handlers.User, error) {
 }
 
 func GetUserByLogin(DB *sql.DB, login string) (*handlers.User, error) {
-	query := "SELECT id, login, password, created_at, online FROM users WHERE login = ?"
+	defer observe("get_user_by_login", time.Now())
+	query := "SELECT id, login, password, created_at, online, role, banned_until FROM users WHERE login = ?"
 	row := DB.QueryRow(query, login)
 
 	var user handlers.User
-	err := row.Scan(&user.Id, &user.Login, &user.HashPassword, &user.CreatedAt, &user.Online)
+	var bannedUntil sql.NullTime
+	err := row.Scan(&user.Id, &user.Login, &user.HashPassword, &user.CreatedAt, &user.Online, &user.Role, &bannedUntil)
 	if err != nil {
 		return nil, err
 	}
+	user.BannedUntil = bannedUntil.Time
 
 	return &user, nil
 }
 
 func CreateConversation(DB *sql.DB, user1Id int, user2Id int) (*handlers.Conversation, error) {
+	defer observe("create_conversation", time.Now())
 	existingConv, err := GetConversationBetweenUsers(DB, user1Id, user2Id)
 	if err == nil && existingConv != nil {
 		return existingConv, nil
@@ -74,6 +94,7 @@ func CreateConversation(DB *sql.DB, user1Id int, user2Id int) (*handlers.Convers
 }
 
 func GetConversationBetweenUsers(db *sql.DB, user1ID, user2ID int) (*handlers.Conversation, error) {
+	defer observe("get_conversation_between_users", time.Now())
 	query := `SELECT id, user1_id, user2_id, created_at FROM conversations 
 				WHERE (user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?)`
 	row := db.QueryRow(query, user1ID, user2ID, user2ID, user1ID)
@@ -88,6 +109,7 @@ func GetConversationBetweenUsers(db *sql.DB, user1ID, user2ID int) (*handlers.Co
 }
 
 func GetConversationByID(db *sql.DB, id int) (*handlers.Conversation, error) {
+	defer observe("get_conversation_by_id", time.Now())
 	query := "SELECT id, user1_id, user2_id, created_at FROM conversations WHERE id = ?"
 	row := db.QueryRow(query, id)
 
@@ -103,9 +125,55 @@ func GetConversationByID(db *sql.DB, id int) (*handlers.Conversation, error) {
 	return &conversation, nil
 }
 
-func CreateMsg(DB *sql.DB, conversationID int, senderID int, body string, sentAt time.Time) (*handlers.DataBaseMsg, error) {
-	query := "INSERT INTO messages (conversation_id, sender_id, body, sent_at) VALUES (?, ?, ?, ?)"
-	result, err := DB.Exec(query, conversationID, senderID, body, sentAt)
+// nullableID превращает 0 в NULL для необязательных ссылок на другие строки
+func nullableID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// CreateMsg добавляет сообщение в переписку; replyTo - id сообщения той же переписки или 0
+// attachment, если не nil, сохраняется в той же транзакции и получает id
+func CreateMsg(DB *sql.DB, conversationID int, senderID int, body string, sentAt time.Time, replyTo int, attachment *handlers.Attachment) (*handlers.DataBaseMsg, error) {
+	defer observe("create_msg", time.Now())
+	// в базе sent_at хранится с точностью до миллисекунд
+	sentAt = sentAt.Truncate(time.Millisecond)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// ответ наследует ветку родителя, а ответ на корневое сообщение открывает новую
+	var threadRoot int
+	var quote string
+	if replyTo != 0 {
+		var parentConversation int
+		err = tx.QueryRow(`SELECT conversation_id, COALESCE(thread_root_id, id), IF(deleted_at IS NULL, LEFT(body, 80), '')
+            FROM messages WHERE id = ?`, replyTo).Scan(&parentConversation, &threadRoot, &quote)
+		if err == sql.ErrNoRows || (err == nil && parentConversation != conversationID) {
+			return nil, ErrReplyOutside
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// строка переписки блокируется до конца транзакции, так что номера не повторяются
+	_, err = tx.Exec("UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ?", conversationID)
+	if err != nil {
+		return nil, err
+	}
+	var seq int64
+	err = tx.QueryRow("SELECT last_seq FROM conversations WHERE id = ?", conversationID).Scan(&seq)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "INSERT INTO messages (conversation_id, sender_id, body, sent_at, seq, reply_to, thread_root_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(query, conversationID, senderID, body, sentAt, seq, nullableID(replyTo), nullableID(threadRoot))
 	if err != nil {
 		return nil, err
 	}
@@ -113,21 +181,53 @@ func CreateMsg(DB *sql.DB, conversationID int, senderID int, body string, sentAt
 	if err != nil {
 		return nil, err
 	}
+	if attachment != nil {
+		err = insertAttachment(tx, int(id), attachment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 	msg := handlers.DataBaseMsg{
 		ID:             int(id),
 		ConversationId: conversationID,
 		SenderId:       senderID,
 		Body:           body,
 		SentAt:         sentAt,
+		Seq:            seq,
+		ReplyTo:        replyTo,
+		ThreadRootId:   threadRoot,
+		ReplyQuote:     quote,
+		Attachment:     attachment,
 	}
 	return &msg, nil
 }
 
+// msgColumns - колонки messages в порядке, который ожидает scanMsg; в запросе
+// таблица messages не должна иметь псевдонима, на нее ссылается подзапрос цитаты
+const msgColumns = `id, conversation_id, sender_id, body, sent_at, seq, edited_at, deleted_at,
+    COALESCE(reply_to, 0), COALESCE(thread_root_id, 0),
+    COALESCE((SELECT LEFT(parent.body, 80) FROM messages parent
+        WHERE parent.id = messages.reply_to AND parent.deleted_at IS NULL), '')`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMsg(row scanner, msg *handlers.DataBaseMsg) error {
+	return row.Scan(&msg.ID, &msg.ConversationId, &msg.SenderId, &msg.Body, &msg.SentAt, &msg.Seq,
+		&msg.EditedAt, &msg.DeletedAt, &msg.ReplyTo, &msg.ThreadRootId, &msg.ReplyQuote)
+}
+
 func GetMsgById(DB *sql.DB, id int) (*handlers.DataBaseMsg, error) {
-	query := "SELECT id, conversation_id, sender_id, body, sent_at FROM messages WHERE id = ?"
+	defer observe("get_msg_by_id", time.Now())
+	query := "SELECT " + msgColumns + " FROM messages WHERE id = ?"
 	row := DB.QueryRow(query, id)
 	var msg handlers.DataBaseMsg
-	err := row.Scan(&msg.ID, &msg.ConversationId, &msg.SenderId, &msg.Body, &msg.SentAt)
+	err := scanMsg(row, &msg)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +235,8 @@ func GetMsgById(DB *sql.DB, id int) (*handlers.DataBaseMsg, error) {
 }
 
 func GetMsgsByConversationID(DB *sql.DB, conversationID int) ([]handlers.DataBaseMsg, error) {
-	query := "SELECT id, conversation_id, sender_id, body, sent_at FROM messages WHERE conversation_id = ? ORDER BY sent_at ASC"
+	defer observe("get_msgs_by_conversation_id", time.Now())
+	query := "SELECT " + msgColumns + " FROM messages WHERE conversation_id = ? ORDER BY seq ASC"
 	rows, err := DB.Query(query, conversationID)
 	if err != nil {
 		return nil, err
@@ -144,7 +245,7 @@ func GetMsgsByConversationID(DB *sql.DB, conversationID int) ([]handlers.DataBas
 	var msgs []handlers.DataBaseMsg
 	for rows.Next() {
 		var msg handlers.DataBaseMsg
-		err := rows.Scan(&msg.ID, &msg.ConversationId, &msg.SenderId, &msg.Body, &msg.SentAt)
+		err := scanMsg(rows, &msg)
 		if err != nil {
 			return nil, err
 		}
@@ -153,17 +254,20 @@ func GetMsgsByConversationID(DB *sql.DB, conversationID int) ([]handlers.DataBas
 	return msgs, nil
 }
 
+// GetAllUserMessages возвращает переписки пользователя без сообщений, которые он удалил у себя
 func GetAllUserMessages(db *sql.DB, userID int) ([]handlers.DataBaseMsg, error) {
+    defer observe("get_all_user_messages", time.Now())
     query := `
-        SELECT id, conversation_id, sender_id, body, sent_at 
+        SELECT ` + msgColumns + `
         FROM messages 
-        WHERE sender_id = ? OR conversation_id IN (
+        WHERE (sender_id = ? OR conversation_id IN (
             SELECT id FROM conversations 
             WHERE user1_id = ? OR user2_id = ?
-        )
-        ORDER BY sent_at ASC`
+        ))
+        AND id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = ?)
+        ORDER BY conversation_id ASC, seq ASC`
     
-    rows, err := db.Query(query, userID, userID, userID)
+    rows, err := db.Query(query, userID, userID, userID, userID)
     if err != nil {
         return nil, fmt.Errorf("error getting messages: %v", err)
     }
@@ -172,13 +276,21 @@ func GetAllUserMessages(db *sql.DB, userID int) ([]handlers.DataBaseMsg, error)
     var messages []handlers.DataBaseMsg
     for rows.Next() {
         var msg handlers.DataBaseMsg
-        err := rows.Scan(&msg.ID, &msg.ConversationId, &msg.SenderId, &msg.Body, &msg.SentAt)
+        err := scanMsg(rows, &msg)
         if err != nil {
             return nil, err
         }
         messages = append(messages, msg)
     }
 
+    err = attachReactions(db, messages, userID)
+    if err != nil {
+        return nil, err
+    }
+    err = attachAttachments(db, messages, userID)
+    if err != nil {
+        return nil, err
+    }
     return messages, nil
 }
 
@@ -201,6 +313,7 @@ func GetUsersByConversaionId(db *sql.DB, Id int) (*handlers.User, *handlers.User
 }
 
 func UpdateUserOnline(db *sql.DB, id int, online bool) error {
+	defer observe("update_user_online", time.Now())
 	onlineValue := 0
 	if online {
 		onlineValue = 1
@@ -224,18 +337,25 @@ func UpdateUserOnline(db *sql.DB, id int, online bool) error {
 	return nil
 }
 
-func AddMessageToConversation(DB *sql.DB, senderID, receiverID int, body string, sentAt time.Time) error {
+// SetAllUsersOffline сбрасывает флаг online у всех пользователей, нужен при запуске и остановке сервера
+func SetAllUsersOffline(db *sql.DB) error {
+	defer observe("set_all_users_offline", time.Now())
+	_, err := db.Exec("UPDATE users SET online = FALSE WHERE online = TRUE")
+	if err != nil {
+		return fmt.Errorf("error resetting users online: %v", err)
+	}
+	return nil
+}
+
+func AddMessageToConversation(DB *sql.DB, senderID, receiverID int, body string, sentAt time.Time, replyTo int, attachment *handlers.Attachment) (*handlers.DataBaseMsg, error) {
+	defer observe("add_message_to_conversation", time.Now())
 	conversation, err := GetConversationBetweenUsers(DB, senderID, receiverID)
 	if err != nil {
 		conversation, err = CreateConversation(DB, senderID, receiverID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	_, err = CreateMsg(DB, conversation.ID, senderID, body, sentAt)
-	if err != nil {
-		return err
-	}
-	return nil
+	return CreateMsg(DB, conversation.ID, senderID, body, sentAt, replyTo, attachment)
 }
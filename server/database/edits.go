@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+// lockOwnMsg блокирует сообщение до конца транзакции и проверяет, что его автор - userID
+func lockOwnMsg(tx *sql.Tx, msgID int, userID int) (*handlers.DataBaseMsg, error) {
+	var msg handlers.DataBaseMsg
+	err := scanMsg(tx.QueryRow("SELECT "+msgColumns+" FROM messages WHERE id = ? FOR UPDATE", msgID), &msg)
+	if err == sql.ErrNoRows {
+		return nil, ErrMsgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.SenderId != userID {
+		return nil, ErrNotAuthor
+	}
+	if msg.DeletedAt != nil {
+		return nil, ErrMsgDeleted
+	}
+	return &msg, nil
+}
+
+// EditMsg меняет текст сообщения, сохраняя предыдущую версию в message_edits
+func EditMsg(DB *sql.DB, msgID int, editorID int, body string, editedAt time.Time) (*handlers.DataBaseMsg, error) {
+	defer observe("edit_msg", time.Now())
+	editedAt = editedAt.Truncate(time.Millisecond)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg, err := lockOwnMsg(tx, msgID, editorID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO message_edits (message_id, body, edited_at) VALUES (?, ?, ?)", msgID, msg.Body, editedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE messages SET body = ?, edited_at = ? WHERE id = ?", body, editedAt, msgID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	msg.Body = body
+	msg.EditedAt = &editedAt
+	return msg, nil
+}
+
+// DeleteMsgForEveryone помечает сообщение удаленным и стирает его текст вместе с историей правок
+func DeleteMsgForEveryone(DB *sql.DB, msgID int, userID int, deletedAt time.Time) (*handlers.DataBaseMsg, error) {
+	defer observe("delete_msg_for_everyone", time.Now())
+	deletedAt = deletedAt.Truncate(time.Millisecond)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg, err := lockOwnMsg(tx, msgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM message_edits WHERE message_id = ?", msgID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", msgID)
+	if err != nil {
+		return nil, err
+	}
+	// ключ возвращается вызывающему, чтобы он удалил содержимое из хранилища
+	msg.Attachment, err = scanAttachment(tx.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE message_id = ?", msgID))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM attachments WHERE message_id = ?", msgID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE messages SET body = '', deleted_at = ? WHERE id = ?", deletedAt, msgID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	msg.Body = ""
+	msg.DeletedAt = &deletedAt
+	return msg, nil
+}
+
+// GetParticipantMsg возвращает сообщение, если userID - участник его переписки
+func GetParticipantMsg(DB *sql.DB, msgID int, userID int) (*handlers.DataBaseMsg, error) {
+	defer observe("get_participant_msg", time.Now())
+	query := `SELECT ` + msgColumns + ` FROM messages WHERE id = ? AND conversation_id IN (
+            SELECT id FROM conversations WHERE user1_id = ? OR user2_id = ?)`
+	var msg handlers.DataBaseMsg
+	err := scanMsg(DB.QueryRow(query, msgID, userID, userID), &msg)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotParticipant
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// HideMsgForUser удаляет сообщение только из истории пользователя
+func HideMsgForUser(DB *sql.DB, msgID int, userID int) (*handlers.DataBaseMsg, error) {
+	defer observe("hide_msg_for_user", time.Now())
+	msg, err := GetParticipantMsg(DB, msgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = DB.Exec("INSERT IGNORE INTO message_hidden (user_id, message_id) VALUES (?, ?)", userID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
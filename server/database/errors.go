@@ -0,0 +1,20 @@
+package database
+
+import "errors"
+
+var (
+	ErrMsgNotFound    = errors.New("message not found")
+	ErrNotAuthor      = errors.New("only the author can change this message")
+	ErrNotParticipant = errors.New("you are not a participant of this conversation")
+	ErrMsgDeleted     = errors.New("message is deleted")
+	ErrReplyOutside   = errors.New("reply must refer to a message of the same conversation")
+	ErrTooManyReacts  = errors.New("too many reactions on this message")
+	ErrNoAttachment   = errors.New("attachment not found")
+	ErrEmptySearch    = errors.New("search query has no words")
+	ErrNotAllowed     = errors.New("recipient does not accept messages from you")
+	ErrWrongPassword  = errors.New("wrong password")
+	ErrLoginTaken     = errors.New("login is already taken")
+	ErrOwnMsg         = errors.New("you cannot report your own message")
+	ErrReported       = errors.New("you have already reported this message")
+	ErrNoReport       = errors.New("open report not found")
+)
@@ -5,17 +5,70 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// миграции выполняются по порядку при каждом запуске, поэтому каждая должна быть идемпотентной
+var migrations = []func(*sql.DB) error{
+	CreateUserTable,
+	CreateConversationTable,
+	CreateMsgsTable,
+	CreateAuthEventsTable,
+	MigrateMsgsOrdering,
+	MigrateMsgsEditing,
+	MigrateMsgsReplies,
+	CreateReactionsTable,
+	CreateAttachmentsTable,
+	MigrateMsgsSearch,
+	CreateConversationReadsTable,
+	CreateContactsTables,
+	MigrateUsersProfile,
+	MigrateUsersDeletion,
+	MigrateUsersRoles,
+	CreateAdminAuditTable,
+	CreateReportsTable,
+	CreateOfflineFramesTable,
+}
+
 func RunMigrations(DB *sql.DB) error {
-	err := CreateUserTable(DB)
-	if err != nil {
-		return err
+	for _, migration := range migrations {
+		err := migration(DB)
+		if err != nil {
+			return err
+		}
 	}
-	err = CreateConversationTable(DB)
-	if err != nil {
-		return err
+	return nil
+}
+
+func columnExists(DB *sql.DB, table string, column string) (bool, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func indexExists(DB *sql.DB, table string, index string) (bool, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`, table, index).Scan(&count)
+	return count > 0, err
+}
+
+// foreignKeyExists ищет внешний ключ по колонке, а не по имени: у ключей, созданных
+// без CONSTRAINT, имя выбирает MySQL
+func foreignKeyExists(DB *sql.DB, table string, column string, referencedTable string) (bool, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM information_schema.KEY_COLUMN_USAGE
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ? AND REFERENCED_TABLE_NAME = ?`,
+		table, column, referencedTable).Scan(&count)
+	return count > 0, err
+}
+
+// addColumn добавляет колонку, если ее еще нет; возвращает true, если колонка была добавлена
+func addColumn(DB *sql.DB, table string, column string, definition string) (bool, error) {
+	exists, err := columnExists(DB, table, column)
+	if err != nil || exists {
+		return false, err
 	}
-	err = CreateMsgsTable(DB)
-	return err
+	_, err = DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err == nil, err
 }
 
 func CreateUserTable(DB *sql.DB) error {
@@ -41,6 +94,7 @@ func CreateConversationTable(DB *sql.DB) error {
             user1_id INT NOT NULL,
             user2_id INT NOT NULL, 
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            last_seq BIGINT NOT NULL DEFAULT 0,
             UNIQUE KEY unique_pair (user1_id, user2_id), 
             FOREIGN KEY (user1_id) REFERENCES users(id) ON DELETE CASCADE,
             FOREIGN KEY (user2_id) REFERENCES users(id) ON DELETE CASCADE
@@ -59,7 +113,13 @@ func CreateMsgsTable(DB *sql.DB) error {
             conversation_id INT NOT NULL,
             sender_id INT NOT NULL, 
             body TEXT NOT NULL,
-            sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            sent_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            seq BIGINT NOT NULL DEFAULT 0,
+            edited_at TIMESTAMP(3) NULL DEFAULT NULL,
+            deleted_at TIMESTAMP(3) NULL DEFAULT NULL,
+            reply_to INT NULL DEFAULT NULL,
+            thread_root_id INT NULL DEFAULT NULL,
+            UNIQUE KEY unique_conversation_seq (conversation_id, seq),
             FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
             FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
         );`
@@ -69,3 +129,341 @@ func CreateMsgsTable(DB *sql.DB) error {
 	}
 	return nil
 }
+
+func CreateAuthEventsTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS auth_events (
+            id INT PRIMARY KEY AUTO_INCREMENT,
+            login VARCHAR(50) NOT NULL,
+            ip VARCHAR(64) NOT NULL,
+            event VARCHAR(32) NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_auth_events_login (login, created_at)
+        );`
+	_, err := DB.Exec(query)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// MigrateMsgsOrdering переводит базы, созданные до появления seq, на миллисекундные
+// sent_at и порядковые номера сообщений внутри переписки
+func MigrateMsgsOrdering(DB *sql.DB) error {
+	var precision int
+	err := DB.QueryRow(`SELECT DATETIME_PRECISION FROM information_schema.COLUMNS
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'messages' AND COLUMN_NAME = 'sent_at'`).Scan(&precision)
+	if err != nil {
+		return err
+	}
+	if precision < 3 {
+		_, err = DB.Exec("ALTER TABLE messages MODIFY sent_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3)")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = addColumn(DB, "conversations", "last_seq", "BIGINT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(DB, "messages", "seq", "BIGINT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// каждый шаг проверяет свое состояние, чтобы прерванная миграция доделывалась при
+	// следующем запуске. Сообщения без номера (seq = 0) нумеруются в порядке отправки
+	// после уже пронумерованных сообщений своей переписки
+	_, err = DB.Exec(`
+        UPDATE messages m JOIN (
+            SELECT u.id, COALESCE(numbered.base, 0) +
+                ROW_NUMBER() OVER (PARTITION BY u.conversation_id ORDER BY u.sent_at, u.id) AS rn
+            FROM messages u
+            LEFT JOIN (SELECT conversation_id, MAX(seq) AS base FROM messages GROUP BY conversation_id) numbered
+                ON numbered.conversation_id = u.conversation_id
+            WHERE u.seq = 0
+        ) unnumbered ON m.id = unnumbered.id
+        SET m.seq = unnumbered.rn`)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`
+        UPDATE conversations c JOIN (
+            SELECT conversation_id, MAX(seq) AS max_seq FROM messages GROUP BY conversation_id
+        ) m ON m.conversation_id = c.id
+        SET c.last_seq = m.max_seq
+        WHERE c.last_seq < m.max_seq`)
+	if err != nil {
+		return err
+	}
+	exists, err := indexExists(DB, "messages", "unique_conversation_seq")
+	if err != nil || exists {
+		return err
+	}
+	_, err = DB.Exec("ALTER TABLE messages ADD UNIQUE KEY unique_conversation_seq (conversation_id, seq)")
+	return err
+}
+
+func MigrateMsgsEditing(DB *sql.DB) error {
+	_, err := addColumn(DB, "messages", "edited_at", "TIMESTAMP(3) NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(DB, "messages", "deleted_at", "TIMESTAMP(3) NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+
+	query := `
+        CREATE TABLE IF NOT EXISTS message_edits (
+            id INT PRIMARY KEY AUTO_INCREMENT,
+            message_id INT NOT NULL,
+            body TEXT NOT NULL,
+            edited_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+        );`
+	_, err = DB.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        CREATE TABLE IF NOT EXISTS message_hidden (
+            user_id INT NOT NULL,
+            message_id INT NOT NULL,
+            PRIMARY KEY (user_id, message_id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+            FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+        );`
+	_, err = DB.Exec(query)
+	return err
+}
+
+// MigrateMsgsReplies добавляет ссылку на сообщение, на которое отвечают, и корень ветки;
+// колонки могут уже быть из CreateMsgsTable, поэтому ключ и индекс проверяются отдельно
+func MigrateMsgsReplies(DB *sql.DB) error {
+	_, err := addColumn(DB, "messages", "reply_to", "INT NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	exists, err := foreignKeyExists(DB, "messages", "reply_to", "messages")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = DB.Exec("ALTER TABLE messages ADD FOREIGN KEY (reply_to) REFERENCES messages(id) ON DELETE SET NULL")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = addColumn(DB, "messages", "thread_root_id", "INT NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	exists, err = indexExists(DB, "messages", "idx_messages_thread")
+	if err != nil || exists {
+		return err
+	}
+	_, err = DB.Exec("ALTER TABLE messages ADD INDEX idx_messages_thread (thread_root_id)")
+	return err
+}
+
+// CreateReactionsTable создает таблицу реакций; emoji сравниваются побайтно,
+// иначе при обычной сортировке utf8mb4 разные эмодзи считаются равными
+func CreateReactionsTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS message_reactions (
+            message_id INT NOT NULL,
+            user_id INT NOT NULL,
+            emoji VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+            created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            PRIMARY KEY (message_id, user_id, emoji),
+            FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
+
+// CreateAttachmentsTable создает таблицу вложений; само содержимое лежит в blobstore
+func CreateAttachmentsTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS attachments (
+            id INT PRIMARY KEY AUTO_INCREMENT,
+            message_id INT NOT NULL UNIQUE,
+            blob_key VARCHAR(64) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            size BIGINT NOT NULL,
+            content_type VARCHAR(127) NOT NULL DEFAULT '',
+            sha256 CHAR(64) NOT NULL,
+            created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
+
+// MigrateMsgsSearch добавляет полнотекстовый индекс по тексту сообщений
+func MigrateMsgsSearch(DB *sql.DB) error {
+	exists, err := indexExists(DB, "messages", "ft_messages_body")
+	if err != nil || exists {
+		return err
+	}
+	_, err = DB.Exec("ALTER TABLE messages ADD FULLTEXT INDEX ft_messages_body (body)")
+	return err
+}
+
+// CreateConversationReadsTable создает таблицу отметок о прочтении; хранится
+// порядковый номер сообщения, а не id, чтобы непрочитанные считались по seq
+func CreateConversationReadsTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS conversation_reads (
+            user_id INT NOT NULL,
+            conversation_id INT NOT NULL,
+            last_read_seq BIGINT NOT NULL DEFAULT 0,
+            updated_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+            PRIMARY KEY (user_id, conversation_id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+            FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
+
+// CreateContactsTables создает контакты, черный список и настройки приватности;
+// отсутствие строки в privacy_settings означает настройки по умолчанию
+func CreateContactsTables(DB *sql.DB) error {
+	queries := []string{`
+        CREATE TABLE IF NOT EXISTS contacts (
+            user_id INT NOT NULL,
+            contact_id INT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, contact_id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+            FOREIGN KEY (contact_id) REFERENCES users(id) ON DELETE CASCADE
+        );`, `
+        CREATE TABLE IF NOT EXISTS blocks (
+            user_id INT NOT NULL,
+            blocked_id INT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (user_id, blocked_id),
+            INDEX idx_blocks_blocked (blocked_id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+            FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+        );`, `
+        CREATE TABLE IF NOT EXISTS privacy_settings (
+            user_id INT PRIMARY KEY,
+            messages VARCHAR(16) NOT NULL DEFAULT 'everyone',
+            online VARCHAR(16) NOT NULL DEFAULT 'everyone',
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`,
+	}
+	for _, query := range queries {
+		_, err := DB.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateUsersProfile добавляет поля профиля; содержимое аватара лежит в blobstore
+func MigrateUsersProfile(DB *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"display_name", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"bio", "VARCHAR(280) NOT NULL DEFAULT ''"},
+		{"timezone", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"avatar_key", "VARCHAR(64) NULL DEFAULT NULL"},
+		{"avatar_size", "BIGINT NOT NULL DEFAULT 0"},
+		{"avatar_type", "VARCHAR(127) NOT NULL DEFAULT ''"},
+		{"avatar_sha256", "CHAR(64) NOT NULL DEFAULT ''"},
+	}
+	for _, column := range columns {
+		_, err := addColumn(DB, "users", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateUsersDeletion добавляет отметку об удалении аккаунта; удаленный с анонимизацией
+// аккаунт остается в таблице, чтобы его сообщения не пропали у собеседников
+func MigrateUsersDeletion(DB *sql.DB) error {
+	_, err := addColumn(DB, "users", "deleted_at", "TIMESTAMP NULL DEFAULT NULL")
+	return err
+}
+
+// MigrateUsersRoles добавляет роль и блокировку аккаунта; DATETIME, а не TIMESTAMP,
+// чтобы бессрочный бан не упирался в 2038 год
+func MigrateUsersRoles(DB *sql.DB) error {
+	_, err := addColumn(DB, "users", "role", "VARCHAR(16) NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(DB, "users", "banned_until", "DATETIME NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	_, err = addColumn(DB, "users", "ban_reason", "VARCHAR(280) NOT NULL DEFAULT ''")
+	return err
+}
+
+func CreateAdminAuditTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS admin_audit (
+            id INT PRIMARY KEY AUTO_INCREMENT,
+            actor VARCHAR(64) NOT NULL,
+            command VARCHAR(32) NOT NULL,
+            target VARCHAR(50) NOT NULL DEFAULT '',
+            details TEXT NOT NULL,
+            result VARCHAR(16) NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_admin_audit_created (created_at),
+            INDEX idx_admin_audit_target (target, created_at)
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
+
+// CreateReportsTable создает жалобы на сообщения; reporter_id пустой у отметок фильтров,
+// body - текст сообщения на момент жалобы, он остается, даже если сообщение удалят у всех
+func CreateReportsTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS message_reports (
+            id INT PRIMARY KEY AUTO_INCREMENT,
+            message_id INT NOT NULL,
+            reporter_id INT NULL DEFAULT NULL,
+            source VARCHAR(16) NOT NULL,
+            reason VARCHAR(280) NOT NULL DEFAULT '',
+            body TEXT NOT NULL,
+            status VARCHAR(16) NOT NULL DEFAULT 'open',
+            resolved_by INT NULL DEFAULT NULL,
+            resolved_at TIMESTAMP NULL DEFAULT NULL,
+            created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            UNIQUE KEY unique_message_reporter (message_id, reporter_id),
+            INDEX idx_message_reports_status (status, created_at),
+            FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+            FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE SET NULL,
+            FOREIGN KEY (resolved_by) REFERENCES users(id) ON DELETE SET NULL
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
+
+// CreateOfflineFramesTable создает офлайн очередь: события, которые не успели отправить
+// медленному клиенту при политике spill; они досылаются при следующем входе
+func CreateOfflineFramesTable(DB *sql.DB) error {
+	query := `
+        CREATE TABLE IF NOT EXISTS offline_frames (
+            id BIGINT PRIMARY KEY AUTO_INCREMENT,
+            user_id INT NOT NULL,
+            frame MEDIUMBLOB NOT NULL,
+            created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+            INDEX idx_offline_frames_user (user_id, id),
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+        );`
+	_, err := DB.Exec(query)
+	return err
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AddOfflineFrames сохраняет кадры, которые не удалось отправить пользователю,
+// для доставки при следующем входе; порядок кадров сохраняется
+func AddOfflineFrames(DB *sql.DB, userID int, frames [][]byte) error {
+	defer observe("add_offline_frames", time.Now())
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO offline_frames (user_id, frame) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, frame := range frames {
+		_, err = stmt.Exec(userID, frame)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TakeOfflineFrames возвращает накопленные кадры пользователя по порядку и удаляет их
+func TakeOfflineFrames(DB *sql.DB, userID int) ([][]byte, error) {
+	defer observe("take_offline_frames", time.Now())
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, frame FROM offline_frames WHERE user_id = ? ORDER BY id FOR UPDATE", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var frames [][]byte
+	var lastID int64
+	for rows.Next() {
+		var frame []byte
+		if err := rows.Scan(&lastID, &frame); err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	_, err = tx.Exec("DELETE FROM offline_frames WHERE user_id = ? AND id <= ?", userID, lastID)
+	if err != nil {
+		return nil, err
+	}
+	return frames, tx.Commit()
+}
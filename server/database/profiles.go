@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+// GetProfile возвращает профиль пользователя; ключ аватара остается в Avatar.Key,
+// перед отправкой клиенту его нужно убрать
+func GetProfile(DB *sql.DB, userID int) (*handlers.Profile, error) {
+	defer observe("get_profile", time.Now())
+	var profile handlers.Profile
+	var avatar handlers.Attachment
+	var avatarKey sql.NullString
+	err := DB.QueryRow(`SELECT login, display_name, bio, timezone, avatar_key, avatar_size, avatar_type, avatar_sha256
+        FROM users WHERE id = ?`, userID).Scan(&profile.Login, &profile.DisplayName, &profile.Bio, &profile.Timezone,
+		&avatarKey, &avatar.Size, &avatar.ContentType, &avatar.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if avatarKey.Valid {
+		avatar.Key = avatarKey.String
+		avatar.Name = "avatar"
+		profile.Avatar = &avatar
+	}
+	return &profile, nil
+}
+
+// UpdateProfile меняет текстовые поля профиля
+func UpdateProfile(DB *sql.DB, userID int, profile handlers.Profile) error {
+	defer observe("update_profile", time.Now())
+	_, err := DB.Exec("UPDATE users SET display_name = ?, bio = ?, timezone = ? WHERE id = ?",
+		profile.DisplayName, profile.Bio, profile.Timezone, userID)
+	return err
+}
+
+// SetAvatar заменяет аватар и возвращает ключ прежнего, чтобы вызывающий удалил его из хранилища
+func SetAvatar(DB *sql.DB, userID int, avatar handlers.Attachment) (string, error) {
+	defer observe("set_avatar", time.Now())
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldKey sql.NullString
+	err = tx.QueryRow("SELECT avatar_key FROM users WHERE id = ? FOR UPDATE", userID).Scan(&oldKey)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("UPDATE users SET avatar_key = ?, avatar_size = ?, avatar_type = ?, avatar_sha256 = ? WHERE id = ?",
+		avatar.Key, avatar.Size, avatar.ContentType, avatar.SHA256, userID)
+	if err != nil {
+		return "", err
+	}
+	return oldKey.String, tx.Commit()
+}
+
+// IsBlockedBy проверяет, заблокировал ли ownerID пользователя userID
+func IsBlockedBy(DB *sql.DB, userID int, ownerID int) (bool, error) {
+	defer observe("is_blocked_by", time.Now())
+	var blocked bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM blocks WHERE user_id = ? AND blocked_id = ?)", ownerID, userID).Scan(&blocked)
+	return blocked, err
+}
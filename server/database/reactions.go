@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+// MaxReactionsPerUser - сколько разных эмодзи один пользователь может поставить на сообщение
+const MaxReactionsPerUser = 10
+
+// reactableMsg возвращает сообщение, на которое userID может реагировать
+func reactableMsg(DB *sql.DB, msgID int, userID int) (*handlers.DataBaseMsg, error) {
+	msg, err := GetParticipantMsg(DB, msgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.DeletedAt != nil {
+		return nil, ErrMsgDeleted
+	}
+	return msg, nil
+}
+
+// AddReaction ставит реакцию на сообщение; повторная та же реакция ничего не меняет
+func AddReaction(DB *sql.DB, msgID int, userID int, emoji string) (*handlers.DataBaseMsg, error) {
+	defer observe("add_reaction", time.Now())
+	msg, err := reactableMsg(DB, msgID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	err = DB.QueryRow("SELECT COUNT(*) FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji <> ?",
+		msgID, userID, emoji).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count >= MaxReactionsPerUser {
+		return nil, ErrTooManyReacts
+	}
+
+	_, err = DB.Exec("INSERT IGNORE INTO message_reactions (message_id, user_id, emoji) VALUES (?, ?, ?)", msgID, userID, emoji)
+	if err != nil {
+		return nil, err
+	}
+	msg.Reactions, err = GetReactionCounts(DB, msgID)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// RemoveReaction снимает реакцию пользователя с сообщения
+func RemoveReaction(DB *sql.DB, msgID int, userID int, emoji string) (*handlers.DataBaseMsg, error) {
+	defer observe("remove_reaction", time.Now())
+	msg, err := reactableMsg(DB, msgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = DB.Exec("DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?", msgID, userID, emoji)
+	if err != nil {
+		return nil, err
+	}
+	msg.Reactions, err = GetReactionCounts(DB, msgID)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetReactionCounts возвращает число реакций на сообщение по каждому эмодзи
+func GetReactionCounts(DB *sql.DB, msgID int) (map[string]int, error) {
+	defer observe("get_reaction_counts", time.Now())
+	rows, err := DB.Query("SELECT emoji, COUNT(*) FROM message_reactions WHERE message_id = ? GROUP BY emoji", msgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var emoji string
+		var count int
+		err := rows.Scan(&emoji, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[emoji] = count
+	}
+	return counts, rows.Err()
+}
+
+// attachReactions заполняет счетчики реакций у сообщений из переписок userID одним запросом
+func attachReactions(DB *sql.DB, msgs []handlers.DataBaseMsg, userID int) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	query := `
+        SELECT r.message_id, r.emoji, COUNT(*)
+        FROM message_reactions r
+        JOIN messages m ON m.id = r.message_id
+        WHERE m.conversation_id IN (SELECT id FROM conversations WHERE user1_id = ? OR user2_id = ?)
+        GROUP BY r.message_id, r.emoji`
+	rows, err := DB.Query(query, userID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[int]int, len(msgs))
+	for i := range msgs {
+		index[msgs[i].ID] = i
+	}
+	for rows.Next() {
+		var msgID, count int
+		var emoji string
+		err := rows.Scan(&msgID, &emoji, &count)
+		if err != nil {
+			return err
+		}
+		i, ok := index[msgID]
+		if !ok {
+			continue
+		}
+		if msgs[i].Reactions == nil {
+			msgs[i].Reactions = make(map[string]int)
+		}
+		msgs[i].Reactions[emoji] = count
+	}
+	return rows.Err()
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"time"
+)
+
+// MarkRead сдвигает отметку о прочтении вперед; отметка никогда не уменьшается,
+// так что запоздавший запрос не вернет прочитанные сообщения в непрочитанные
+func MarkRead(DB *sql.DB, userID int, conversationID int, seq int64) error {
+	defer observe("mark_read", time.Now())
+	query := `INSERT INTO conversation_reads (user_id, conversation_id, last_read_seq) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE last_read_seq = GREATEST(last_read_seq, VALUES(last_read_seq))`
+	_, err := DB.Exec(query, userID, conversationID, seq)
+	return err
+}
+
+// conversationInfoQuery выбирает переписки пользователя с последним сообщением
+// и числом непрочитанных сообщений собеседника; удаленные у всех и скрытые сообщения
+// не считаются. Последнее сообщение - самое позднее из не скрытых пользователем:
+// обход уникального индекса (conversation_id, seq) с конца останавливается на первом
+// же подходящем, обычно это сообщение с conversations.last_seq.
+// Online собеседника виден с учетом его черного списка и настроек приватности
+const conversationInfoQuery = `
+        SELECT c.id, u.login, u.display_name, ` + onlineVisibleExpr + `, COALESCE(r.last_read_seq, 0),
+            (SELECT COUNT(*) FROM messages m
+                WHERE m.conversation_id = c.id AND m.seq > COALESCE(r.last_read_seq, 0)
+                AND m.sender_id <> ? AND m.deleted_at IS NULL
+                AND m.id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = ?)),
+            c.last_seq, COALESCE(sender.login, ''), COALESCE(LEFT(lm.body, 80), ''),
+            lm.deleted_at IS NOT NULL, COALESCE(a.name, ''),
+            COALESCE(lm.sent_at, c.created_at) AS last_activity
+        FROM conversations c
+        JOIN users u ON u.id = IF(c.user1_id = ?, c.user2_id, c.user1_id)
+        LEFT JOIN privacy_settings p ON p.user_id = u.id
+        LEFT JOIN conversation_reads r ON r.conversation_id = c.id AND r.user_id = ?
+        LEFT JOIN messages lm ON lm.id = (SELECT m.id FROM messages m
+                WHERE m.conversation_id = c.id
+                AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.user_id = ? AND h.message_id = m.id)
+                ORDER BY m.seq DESC LIMIT 1)
+        LEFT JOIN users sender ON sender.id = lm.sender_id
+        LEFT JOIN attachments a ON a.message_id = lm.id
+        WHERE (c.user1_id = ? OR c.user2_id = ?)`
+
+func conversationInfoArgs(userID int) []any {
+	return []any{userID, userID, userID, userID, userID, userID, userID, userID, userID}
+}
+
+func scanConversationInfo(row scanner, info *handlers.ConversationInfo) error {
+	var lastActivity time.Time
+	err := row.Scan(&info.ID, &info.Peer, &info.PeerName, &info.PeerOnline, &info.LastReadSeq, &info.Unread,
+		&info.LastSeq, &info.LastSender, &info.LastText, &info.LastDeleted, &info.LastAttachment, &lastActivity)
+	if err != nil {
+		return err
+	}
+	info.LastActivity = lastActivity.UnixMilli()
+	return nil
+}
+
+// GetConversationInfos возвращает все переписки пользователя, сначала самые недавно активные
+func GetConversationInfos(DB *sql.DB, userID int) ([]handlers.ConversationInfo, error) {
+	defer observe("get_conversation_infos", time.Now())
+	rows, err := DB.Query(conversationInfoQuery+" ORDER BY last_activity DESC, c.id DESC", conversationInfoArgs(userID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var infos []handlers.ConversationInfo
+	for rows.Next() {
+		var info handlers.ConversationInfo
+		err := scanConversationInfo(rows, &info)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// GetConversationInfo возвращает одну переписку пользователя
+func GetConversationInfo(DB *sql.DB, userID int, conversationID int) (*handlers.ConversationInfo, error) {
+	defer observe("get_conversation_info", time.Now())
+	var info handlers.ConversationInfo
+	args := append(conversationInfoArgs(userID), conversationID)
+	err := scanConversationInfo(DB.QueryRow(conversationInfoQuery+" AND c.id = ?", args...), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
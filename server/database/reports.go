@@ -0,0 +1,98 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"server/handlers"
+)
+
+// сколько открытых жалоб отдается модератору за раз
+const MaxReportsPerPage = 50
+
+// AddReport сохраняет жалобу участника переписки на сообщение собеседника
+func AddReport(DB *sql.DB, msgID int, reporterID int, reason string) error {
+	defer observe("add_report", time.Now())
+	msg, err := GetParticipantMsg(DB, msgID, reporterID)
+	if err != nil {
+		return err
+	}
+	if msg.SenderId == reporterID {
+		return ErrOwnMsg
+	}
+	_, err = DB.Exec("INSERT INTO message_reports (message_id, reporter_id, source, reason, body) VALUES (?, ?, ?, ?, ?)",
+		msgID, reporterID, handlers.ReportSourceUser, reason, msg.Body)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrReported
+	}
+	return err
+}
+
+// FlagMsg отправляет сообщение на проверку по срабатыванию фильтра вместе с его текущим текстом
+func FlagMsg(DB *sql.DB, msgID int, reason string) error {
+	defer observe("flag_msg", time.Now())
+	result, err := DB.Exec(`INSERT INTO message_reports (message_id, source, reason, body)
+        SELECT id, ?, ?, body FROM messages WHERE id = ?`, handlers.ReportSourceFilter, reason, msgID)
+	if err != nil {
+		return err
+	}
+	added, err := result.RowsAffected()
+	if err == nil && added == 0 {
+		err = ErrMsgNotFound
+	}
+	return err
+}
+
+// GetOpenReports возвращает открытые жалобы, начиная с самых старых
+func GetOpenReports(DB *sql.DB) ([]handlers.Report, error) {
+	defer observe("get_open_reports", time.Now())
+	rows, err := DB.Query(`SELECT r.id, r.message_id, s.login,
+            (SELECT u.login FROM users u WHERE u.id IN (c.user1_id, c.user2_id) AND u.id <> m.sender_id LIMIT 1),
+            r.body, COALESCE(rep.login, ''), r.source, r.reason, r.created_at
+        FROM message_reports r
+        JOIN messages m ON m.id = r.message_id
+        JOIN conversations c ON c.id = m.conversation_id
+        JOIN users s ON s.id = m.sender_id
+        LEFT JOIN users rep ON rep.id = r.reporter_id
+        WHERE r.status = ?
+        ORDER BY r.created_at, r.id
+        LIMIT ?`, handlers.ReportOpen, MaxReportsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []handlers.Report
+	for rows.Next() {
+		var report handlers.Report
+		var receiver sql.NullString
+		var createdAt time.Time
+		err := rows.Scan(&report.ID, &report.MessageID, &report.Sender, &receiver, &report.Text,
+			&report.Reporter, &report.Source, &report.Reason, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		report.Receiver = receiver.String
+		report.CreatedAt = createdAt.UnixMilli()
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// CloseReport закрывает открытую жалобу со статусом status
+func CloseReport(DB *sql.DB, reportID int, moderatorID int, status string) error {
+	defer observe("close_report", time.Now())
+	result, err := DB.Exec(`UPDATE message_reports SET status = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND status = ?`, status, moderatorID, reportID, handlers.ReportOpen)
+	if err != nil {
+		return err
+	}
+	closed, err := result.RowsAffected()
+	if err == nil && closed == 0 {
+		err = ErrNoReport
+	}
+	return err
+}
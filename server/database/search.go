@@ -0,0 +1,104 @@
+package database
+
+import (
+	"database/sql"
+	"server/handlers"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxSearchResults - сколько сообщений возвращает один поиск
+const MaxSearchResults = 50
+
+type SearchQuery struct {
+	Text string
+	// 0 - во всех переписках пользователя
+	PeerID int
+	// нулевое время - без ограничения
+	Since time.Time
+	Until time.Time
+}
+
+// minTokenSize совпадает с innodb_ft_min_token_size: более короткие слова не попадают
+// в полнотекстовый индекс
+const minTokenSize = 3
+
+// stopwords - список INNODB_FT_DEFAULT_STOPWORD; этих слов тоже нет в индексе
+var stopwords = map[string]bool{
+	"a": true, "about": true, "an": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "com": true, "de": true, "en": true, "for": true,
+	"from": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"la": true, "of": true, "on": true, "or": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "what": true, "when": true, "where": true,
+	"who": true, "will": true, "with": true, "und": true, "www": true,
+}
+
+// booleanQuery превращает текст в запрос BOOLEAN MODE, где каждое слово
+// обязательно и ищется по префиксу; операторы MySQL из текста выбрасываются.
+// Короткие слова и стоп-слова отбрасываются: обязательное слово, которого нет
+// в индексе, не дало бы найти ничего
+func booleanQuery(text string) string {
+	words := strings.FieldsFunc(text, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if utf8.RuneCountInString(word) < minTokenSize || stopwords[strings.ToLower(word)] {
+			continue
+		}
+		terms = append(terms, "+"+word+"*")
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchMsgs ищет по тексту сообщений в переписках userID, начиная с самых новых;
+// удаленные у всех и скрытые пользователем сообщения не находятся
+func SearchMsgs(DB *sql.DB, userID int, query SearchQuery) ([]handlers.DataBaseMsg, error) {
+	defer observe("search_msgs", time.Now())
+	terms := booleanQuery(query.Text)
+	if terms == "" {
+		return nil, ErrEmptySearch
+	}
+
+	sqlQuery := `
+        SELECT ` + msgColumns + `
+        FROM messages
+        WHERE MATCH(body) AGAINST(? IN BOOLEAN MODE)
+        AND deleted_at IS NULL
+        AND conversation_id IN (SELECT id FROM conversations WHERE user1_id = ? OR user2_id = ?)
+        AND id NOT IN (SELECT message_id FROM message_hidden WHERE user_id = ?)`
+	args := []any{terms, userID, userID, userID}
+	if query.PeerID != 0 {
+		sqlQuery += ` AND conversation_id IN (SELECT id FROM conversations
+            WHERE (user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?))`
+		args = append(args, userID, query.PeerID, query.PeerID, userID)
+	}
+	if !query.Since.IsZero() {
+		sqlQuery += " AND sent_at >= ?"
+		args = append(args, query.Since)
+	}
+	if !query.Until.IsZero() {
+		sqlQuery += " AND sent_at < ?"
+		args = append(args, query.Until)
+	}
+	sqlQuery += " ORDER BY sent_at DESC, id DESC LIMIT ?"
+	args = append(args, MaxSearchResults)
+
+	rows, err := DB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []handlers.DataBaseMsg
+	for rows.Next() {
+		var msg handlers.DataBaseMsg
+		err := scanMsg(rows, &msg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"server/database"
+	"server/handlers"
+	"server/moderation"
+)
+
+// processEdit меняет текст сообщения и рассылает правку участникам; вызывать под server.mutex
+func (server *Server) processEdit(ctx context.Context, msgJSON handlers.Msg) {
+	editor, err := server.frameUser(ctx, msgJSON.SenderID, msgJSON.Sender)
+	if err != nil {
+		server.logger.Warn("sender not found", "user", msgJSON.Sender, "user_id", msgJSON.SenderID)
+		return
+	}
+
+	// правка доходит до собеседника так же, как новое сообщение, поэтому проходит
+	// те же проверки блокировок, приватности и фильтров
+	err = server.checkPeer(ctx, editor, msgJSON.ID)
+	if err != nil {
+		server.logger.Info("edit not allowed", "user", editor.Login, "message_id", msgJSON.ID, "error", err)
+		server.deliver(editor, errorMsg(msgJSON, err))
+		return
+	}
+	verdict := server.moderate(msgJSON)
+	if verdict.Action == moderation.Reject {
+		server.deliver(editor, errorMsg(msgJSON, errRejected))
+		return
+	}
+	msgJSON.Text = verdict.Text
+	var dbMsg *handlers.DataBaseMsg
+	err = traceDB(ctx, "edit_msg", func() (err error) {
+		dbMsg, err = database.EditMsg(server.DB, msgJSON.ID, editor.Id, msgJSON.Text, time.UnixMilli(msgJSON.Timestamp))
+		return err
+	})
+	if err != nil {
+		server.logger.Info("edit message", "user", editor.Login, "message_id", msgJSON.ID, "error", err)
+		server.deliver(editor, errorMsg(msgJSON, err))
+		return
+	}
+	if verdict.Flagged {
+		server.flag(dbMsg.ID, verdict)
+	}
+	server.broadcastChange(ctx, *dbMsg, editor, handlers.TypeEdit, "")
+	server.logger.Info("message edited", "user", editor.Login, "conversation_id", dbMsg.ConversationId, "message_id", dbMsg.ID)
+}
+
+// processDelete удаляет сообщение у отправителя запроса или у всех участников; вызывать под server.mutex
+func (server *Server) processDelete(ctx context.Context, msgJSON handlers.Msg) {
+	user, err := server.frameUser(ctx, msgJSON.SenderID, msgJSON.Sender)
+	if err != nil {
+		server.logger.Warn("sender not found", "user", msgJSON.Sender, "user_id", msgJSON.SenderID)
+		return
+	}
+
+	// удалить свое сообщение можно всегда, даже если собеседник заблокировал автора:
+	// DeleteMsgForEveryone сам проверяет, что сообщение принадлежит user
+	var dbMsg *handlers.DataBaseMsg
+	if msgJSON.Scope == handlers.DeleteForEveryone {
+		err = traceDB(ctx, "delete_msg_for_everyone", func() (err error) {
+			dbMsg, err = database.DeleteMsgForEveryone(server.DB, msgJSON.ID, user.Id, time.UnixMilli(msgJSON.Timestamp))
+			return err
+		})
+	} else {
+		err = traceDB(ctx, "hide_msg_for_user", func() (err error) {
+			dbMsg, err = database.HideMsgForUser(server.DB, msgJSON.ID, user.Id)
+			return err
+		})
+	}
+	if err != nil {
+		server.logger.Info("delete message", "user", user.Login, "message_id", msgJSON.ID, "error", err)
+		server.deliver(user, errorMsg(msgJSON, err))
+		return
+	}
+
+	if msgJSON.Scope == handlers.DeleteForEveryone {
+		if dbMsg.Attachment != nil {
+			server.deleteBlob(dbMsg.Attachment.Key)
+			dbMsg.Attachment = nil
+		}
+		server.broadcastChange(ctx, *dbMsg, user, handlers.TypeDelete, handlers.DeleteForEveryone)
+	} else {
+		user1, user2, err := database.GetUsersByConversaionId(server.DB, dbMsg.ConversationId)
+		if err != nil {
+			server.logger.Error("get conversation users", "conversation_id", dbMsg.ConversationId, "error", err)
+			return
+		}
+		event := msgFromDB(*dbMsg, user1, user2)
+		event.Type = handlers.TypeDelete
+		event.Scope = handlers.DeleteForMe
+		server.deliver(user, event)
+	}
+	server.logger.Info("message deleted", "user", user.Login, "scope", msgJSON.Scope,
+		"conversation_id", dbMsg.ConversationId, "message_id", dbMsg.ID)
+}
+
+// broadcastChange рассылает участникам переписки событие actor об изменении сообщения;
+// собеседник получает правку, только если принимает сообщения от actor, а удаление -
+// всегда, чтобы сообщение пропало и у того, кто заблокировал автора
+func (server *Server) broadcastChange(ctx context.Context, dbMsg handlers.DataBaseMsg, actor *handlers.User, eventType string, scope string) {
+	user1, user2, err := database.GetUsersByConversaionId(server.DB, dbMsg.ConversationId)
+	if err != nil {
+		server.logger.Error("get conversation users", "conversation_id", dbMsg.ConversationId, "error", err)
+		return
+	}
+	event := msgFromDB(dbMsg, user1, user2)
+	event.Type = eventType
+	event.Scope = scope
+	if eventType == handlers.TypeDelete {
+		server.deliver(user1, event)
+		if user2.Id != user1.Id {
+			server.deliver(user2, event)
+		}
+		return
+	}
+	server.deliverToPair(ctx, actor, user1, user2, event)
+}
+
+// deliverToPair отправляет событие actor участникам переписки user1 и user2, пропуская
+// собеседника, который заблокировал actor или закрыл для него сообщения; вызывать под server.mutex
+func (server *Server) deliverToPair(ctx context.Context, actor *handlers.User, user1, user2 *handlers.User, event handlers.Msg) {
+	peer := user1
+	if peer.Id == actor.Id {
+		peer = user2
+	}
+	server.deliver(actor, event)
+	if peer.Id == actor.Id {
+		return
+	}
+	err := traceDB(ctx, "can_message", func() error {
+		return database.CanMessage(server.DB, actor.Id, peer.Id)
+	})
+	if err != nil {
+		server.logger.Info("event not delivered", "user", actor.Login, "receiver", peer.Login, "type", event.Type, "error", err)
+		return
+	}
+	server.deliver(peer, event)
+}
+
+// checkPeer проверяет, что user - участник переписки сообщения msgID и собеседник
+// принимает от него сообщения; вызывать под server.mutex
+func (server *Server) checkPeer(ctx context.Context, user *handlers.User, msgID int) error {
+	var dbMsg *handlers.DataBaseMsg
+	err := traceDB(ctx, "get_participant_msg", func() (err error) {
+		dbMsg, err = database.GetParticipantMsg(server.DB, msgID, user.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	user1, user2, err := database.GetUsersByConversaionId(server.DB, dbMsg.ConversationId)
+	if err != nil {
+		return err
+	}
+	peer := user1
+	if peer.Id == user.Id {
+		peer = user2
+	}
+	return traceDB(ctx, "can_message", func() error {
+		return database.CanMessage(server.DB, user.Id, peer.Id)
+	})
+}
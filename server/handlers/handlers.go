@@ -11,27 +11,313 @@ type Conversation struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// типы служебных сообщений; обычное сообщение чата идет с пустым типом
+const (
+	TypeChat      = ""
+	TypeGoingAway = "going_away"
+	TypePing      = "ping"
+	TypePong      = "pong"
+	TypeThrottled = "throttled"
+	TypeError     = "error"
+	TypeEdit      = "edit"
+	TypeDelete    = "delete"
+	TypeReact     = "react"
+	TypeUnreact   = "unreact"
+
+	// передача файлов: upload_start - upload_chunk... - upload_done, в ответ на
+	// download сервер шлет download_chunk... и download_done
+	TypeUploadStart   = "upload_start"
+	TypeUploadChunk   = "upload_chunk"
+	TypeUploadDone    = "upload_done"
+	TypeUploadAbort   = "upload_abort"
+	TypeDownload      = "download"
+	TypeDownloadChunk = "download_chunk"
+	TypeDownloadDone  = "download_done"
+
+	// поиск по истории: запрос в Text, ответ search_results со списком Results
+	TypeSearch        = "search"
+	TypeSearchResults = "search_results"
+
+	// собеседник набирает сообщение; не сохраняется и доставляется только тем, кто online
+	TypeTyping = "typing"
+
+	// запрос и ответ со списком переписок; read - отметка о прочтении до Seq в переписке с Receiver
+	TypeConversations = "conversations"
+	TypeRead          = "read"
+
+	// контакты и черный список: целевой логин в Receiver, в ответ приходит contacts
+	// с обоими списками; privacy без Privacy запрашивает настройки, с ним - меняет
+	TypeContacts      = "contacts"
+	TypeContactAdd    = "contact_add"
+	TypeContactRemove = "contact_remove"
+	TypeBlock         = "block"
+	TypeUnblock       = "unblock"
+	TypePrivacy       = "privacy"
+
+	// профиль пользователя Receiver (пустой - свой) и изменение своего профиля
+	TypeProfile       = "profile"
+	TypeProfileUpdate = "profile_update"
+
+	// управление аккаунтом; каждое действие подтверждается текущим паролем
+	TypePasswordChange = "password_change"
+	TypeRename         = "rename"
+	TypeAccountDelete  = "account_delete"
+
+	// команда администрирования в Command, цель в Receiver; ответ admin с тем же Command
+	TypeAdmin = "admin"
+	// объявление сервера, рассылается всем, кто online
+	TypeAnnouncement = "announcement"
+	// жалоба на сообщение ID, причина в Text
+	TypeReport = "report"
+)
+
+// откуда жалоба и в каком она состоянии
+const (
+	ReportSourceUser   = "user"
+	ReportSourceFilter = "filter"
+
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// роли пользователей по возрастанию прав
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// команды admin
+const (
+	AdminOnline   = "online"
+	AdminKick     = "kick"
+	AdminBan      = "ban"
+	AdminUnban    = "unban"
+	AdminUnlock   = "unlock"
+	AdminAnnounce = "announce"
+	AdminStats    = "stats"
+	AdminRole     = "role"
+	// открытые жалобы и их закрытие; id жалобы в ID
+	AdminReports = "reports"
+	AdminResolve = "resolve"
+	AdminDismiss = "dismiss"
+)
+
+// назначение загрузки и скачивания файла; пустое - вложение сообщения
+const (
+	PurposeAttachment = ""
+	PurposeAvatar     = "avatar"
+)
+
+// кому доступно действие в настройках приватности
+const (
+	PrivacyEveryone = "everyone"
+	PrivacyContacts = "contacts"
+	PrivacyNobody   = "nobody"
+)
+
+// область удаления для TypeDelete
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
 type Msg struct {
-	Sender    string `json:"sender"`
-	Receiver  string `json:"receiver"`
+	Type     string `json:"type,omitempty"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	// id отправителя и получателя в кадрах kafka: логин может смениться, пока кадр в очереди,
+	// поэтому consumer ищет пользователей по id; заполняет только сервер
+	SenderID   int `json:"sender_id,omitempty"`
+	ReceiverID int `json:"receiver_id,omitempty"`
+	// время в миллисекундах Unix; для сообщений чата его ставит сервер
 	Timestamp int64  `json:"timestamp"`
 	Text      string `json:"text"`
 	Status    int64  `json:"status"`
+	// код ошибки для TypeError
+	Code string `json:"code,omitempty"`
+	// id сообщения в базе и его порядковый номер в переписке; заполняются после сохранения
+	ID  int   `json:"id,omitempty"`
+	Seq int64 `json:"seq,omitempty"`
+
+	Edited  bool `json:"edited,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+	// DeleteForMe или DeleteForEveryone для TypeDelete
+	Scope string `json:"scope,omitempty"`
+
+	// ответ на сообщение ReplyTo с цитатой из него; ThreadID - id первого сообщения ветки
+	ReplyTo  int    `json:"reply_to,omitempty"`
+	Quote    string `json:"quote,omitempty"`
+	ThreadID int    `json:"thread_id,omitempty"`
+
+	// эмодзи для TypeReact и TypeUnreact; Reactions - итоговые счетчики по сообщению ID
+	Emoji     string         `json:"emoji,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// id загрузки, которое сервер выдает в ответ на TypeUploadStart
+	Upload string `json:"upload,omitempty"`
+	// смещение и содержимое куска файла; []byte кодируется в JSON как base64
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// фильтр поиска по времени отправки в миллисекундах Unix, границы [Since, Until)
+	Since   int64 `json:"since,omitempty"`
+	Until   int64 `json:"until,omitempty"`
+	Results []Msg `json:"results,omitempty"`
+
+	// время в миллисекундах Unix, после которого событие TypeTyping устаревает
+	Expires int64 `json:"expires,omitempty"`
+
+	Conversations []ConversationInfo `json:"conversations,omitempty"`
+
+	Contacts []string         `json:"contacts,omitempty"`
+	Blocked  []string         `json:"blocked,omitempty"`
+	Privacy  *PrivacySettings `json:"privacy,omitempty"`
+
+	// PurposeAvatar для upload_start и download: аватар вместо вложения
+	Purpose string   `json:"purpose,omitempty"`
+	Profile *Profile `json:"profile,omitempty"`
+
+	Account *AccountChange `json:"account,omitempty"`
+
+	// для admin: команда, новая роль для role и ответы на online и stats;
+	// срок бана передается в Until, 0 - бессрочно
+	Command string       `json:"command,omitempty"`
+	Role    string       `json:"role,omitempty"`
+	Users   []UserInfo   `json:"users,omitempty"`
+	Stats   *ServerStats `json:"stats,omitempty"`
+	Reports []Report     `json:"reports,omitempty"`
+}
+
+// Report - жалоба на сообщение для модераторов; Reporter пустой у отметок фильтров
+type Report struct {
+	ID        int    `json:"id"`
+	MessageID int    `json:"message_id"`
+	Sender    string `json:"sender"`
+	Receiver  string `json:"receiver"`
+	Text      string `json:"text"`
+	Reporter  string `json:"reporter,omitempty"`
+	Source    string `json:"source"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// UserInfo - пользователь в списке online для администраторов
+type UserInfo struct {
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+// ServerStats - ответ на команду stats
+type ServerStats struct {
+	Uptime        int64 `json:"uptime"`
+	Connections   int   `json:"connections"`
+	OnlineUsers   int   `json:"online_users"`
+	Users         int64 `json:"users"`
+	Conversations int64 `json:"conversations"`
+	Messages      int64 `json:"messages"`
+	Dropped       int64 `json:"dropped"`
+	Spilled       int64 `json:"spilled"`
+	Disconnected  int64 `json:"disconnected"`
+}
+
+// AccountChange - запрос на изменение аккаунта; пароли передаются так же, как
+// при входе, - sha256 от пароля
+type AccountChange struct {
+	Password    [32]byte `json:"password"`
+	NewPassword [32]byte `json:"new_password"`
+	NewLogin    string   `json:"new_login,omitempty"`
+}
+
+// Profile - публичные данные пользователя
+type Profile struct {
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	// имя зоны из базы IANA, например Europe/Moscow; пустое - не указана
+	Timezone string      `json:"timezone"`
+	Avatar   *Attachment `json:"avatar,omitempty"`
+}
+
+// PrivacySettings - кто может писать пользователю и видеть, что он online;
+// значения PrivacyEveryone, PrivacyContacts или PrivacyNobody
+type PrivacySettings struct {
+	Messages string `json:"messages"`
+	Online   string `json:"online"`
+}
+
+// ConversationInfo - строка списка переписок пользователя
+type ConversationInfo struct {
+	ID         int    `json:"id"`
+	Peer       string `json:"peer"`
+	PeerName   string `json:"peer_name,omitempty"`
+	PeerOnline bool   `json:"peer_online"`
+	// порядковый номер последнего прочитанного сообщения
+	LastReadSeq int64 `json:"last_read_seq"`
+	// сколько сообщений собеседника после LastReadSeq
+	Unread int `json:"unread"`
+
+	// последнее сообщение переписки: начало текста, автор, время в миллисекундах Unix
+	// и имя вложения; у переписки без сообщений LastSeq = 0, а время - время ее создания
+	LastSeq        int64  `json:"last_seq"`
+	LastSender     string `json:"last_sender,omitempty"`
+	LastText       string `json:"last_text,omitempty"`
+	LastDeleted    bool   `json:"last_deleted,omitempty"`
+	LastAttachment string `json:"last_attachment,omitempty"`
+	LastActivity   int64  `json:"last_activity"`
+}
+
+// Attachment - файл, прикрепленный к сообщению
+type Attachment struct {
+	ID int `json:"id,omitempty"`
+	// ключ в хранилище; клиентам не отправляется
+	Key         string `json:"key,omitempty"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	// SHA-256 содержимого в hex; клиент присылает его в upload_start, сервер проверяет в upload_done
+	SHA256 string `json:"sha256"`
 }
 
 type DataBaseMsg struct {
-	ID             int       `json:"id"`
-	ConversationId int       `json:"conversation_id"`
-	SenderId       int       `json:"sender_id"`
-	Body           string    `json:"body"`
-	SentAt         time.Time `json:"sent_at"`
+	ID             int        `json:"id"`
+	ConversationId int        `json:"conversation_id"`
+	SenderId       int        `json:"sender_id"`
+	Body           string     `json:"body"`
+	SentAt         time.Time  `json:"sent_at"`
+	Seq            int64      `json:"seq"`
+	EditedAt       *time.Time `json:"edited_at"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+	ReplyTo        int        `json:"reply_to"`
+	ThreadRootId   int        `json:"thread_root_id"`
+	// начало текста сообщения ReplyTo; пустое, если его удалили
+	ReplyQuote string `json:"reply_quote"`
+	// число реакций по каждому эмодзи
+	Reactions  map[string]int `json:"reactions"`
+	Attachment *Attachment    `json:"attachment"`
 }
 
+// статусы ответа сервера на AuthMsg
+const (
+	AuthOk          = 0
+	AuthFailed      = 2
+	AuthUnavailable = 3
+	AuthThrottled   = 4
+	AuthLocked      = 5
+	AuthInvalid     = 6
+	// аккаунт заблокирован до Timestamp
+	AuthBanned = 7
+)
+
 type AuthMsg struct {
 	Login        string   `json:"login"`
 	HashPassword [32]byte `json:"hash_password"`
 	Timestamp    int64    `json:"timestamp"`
 	Status       int64    `json:"status"`
+	// код ошибки проверки для AuthInvalid
+	Code string `json:"code,omitempty"`
 }
 
 type User struct {
@@ -40,4 +326,7 @@ type User struct {
 	HashPassword string    `json:"hash_password"`
 	CreatedAt    time.Time `json:"created_at"`
 	Online       bool      `json:"online"`
+	Role         string    `json:"role"`
+	// нулевое время - аккаунт не заблокирован
+	BannedUntil time.Time `json:"banned_until"`
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"server/database"
+)
+
+// Health хранит результаты последней проверки зависимостей сервера
+type Health struct {
+	mutex    sync.RWMutex
+	database error
+	kafka    error
+	checked  time.Time
+}
+
+func (health *Health) DatabaseOK() bool {
+	health.mutex.RLock()
+	defer health.mutex.RUnlock()
+	return health.database == nil
+}
+
+func (health *Health) set(databaseErr, kafkaErr error) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	health.database = databaseErr
+	health.kafka = kafkaErr
+	health.checked = time.Now()
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+	// nil, пока не прошла первая проверка
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+func checkResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// checkDependencies проверяет базу и kafka и обновляет server.health
+func (server *Server) checkDependencies() {
+	ctx, cancel := context.WithTimeout(context.Background(), server.config.HealthCheckTimeout)
+	defer cancel()
+	databaseErr := database.Ping(ctx, server.DB)
+
+	_, kafkaErr := server.kafkaProducer.GetMetadata(&server.kafkaMsgTopic, false, int(server.config.HealthCheckTimeout.Milliseconds()))
+
+	wasOK := server.health.DatabaseOK()
+	server.health.set(databaseErr, kafkaErr)
+	if databaseErr != nil && wasOK {
+		server.logger.Error("database unreachable, refusing new logins", "error", databaseErr)
+	} else if databaseErr == nil && !wasOK {
+		server.logger.Info("database reachable again")
+	}
+	if kafkaErr != nil {
+		server.logger.Warn("kafka unreachable", "error", kafkaErr)
+	}
+}
+
+func (server *Server) healthChecks(ctx context.Context) {
+	ticker := time.NewTicker(server.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		server.checkDependencies()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeHealth(w http.ResponseWriter, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleHealthz - сервер жив и принимает соединения
+func (server *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	response := healthResponse{Status: "ok"}
+	if !server.tcpServer.Accepting() {
+		response.Status = "down"
+	}
+	writeHealth(w, response)
+}
+
+// handleReadyz - сервер может обслуживать клиентов; при недоступной базе
+// или kafka отвечает degraded
+func (server *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	server.health.mutex.RLock()
+	response := healthResponse{
+		Status: "ok",
+		Checks: map[string]string{
+			"listener": "ok",
+			"database": checkResult(server.health.database),
+			"kafka":    checkResult(server.health.kafka),
+		},
+	}
+	if checked := server.health.checked; !checked.IsZero() {
+		response.CheckedAt = &checked
+	}
+	if server.health.database != nil || server.health.kafka != nil {
+		response.Status = "degraded"
+	}
+	server.health.mutex.RUnlock()
+
+	if !server.tcpServer.Accepting() {
+		response.Checks["listener"] = "not accepting"
+		response.Status = "down"
+	}
+	writeHealth(w, response)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"server/database"
+	"server/handlers"
+)
+
+// startHTTP поднимает служебный HTTP сервер с метриками и проверками состояния
+func (server *Server) startHTTP() {
+	if server.config.HTTPAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.metrics.Handler())
+	mux.HandleFunc("/healthz", server.handleHealthz)
+	mux.HandleFunc("/readyz", server.handleReadyz)
+	mux.HandleFunc("/admin/unlock", server.requireAdmin(server.handleUnlock))
+	mux.HandleFunc("/admin/role", server.requireAdmin(server.handleRole))
+
+	server.httpServer = &http.Server{Addr: server.config.HTTPAddr, Handler: mux}
+	go func() {
+		server.logger.Info("HTTP server start", "addr", server.config.HTTPAddr)
+		err := server.httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			server.logger.Error("HTTP server", "error", err)
+		}
+	}()
+}
+
+// requireAdmin пропускает только запросы с заголовком Authorization: Bearer <AdminToken>
+func (server *Server) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if server.config.AdminToken == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(server.config.AdminToken)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleUnlock снимает блокировку входа: POST /admin/unlock?login=<login>
+func (server *Server) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	login := r.URL.Query().Get("login")
+	if login == "" {
+		http.Error(w, "login is required", http.StatusBadRequest)
+		return
+	}
+	if !server.authGuard.Unlock(login) {
+		http.Error(w, "account is not locked", http.StatusNotFound)
+		return
+	}
+	server.logger.Info("account unlocked by admin", "user", login, "remote", r.RemoteAddr)
+	server.auditAuth(login, r.RemoteAddr, database.AuthEventUnlocked)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRole назначает роль: POST /admin/role?login=<login>&role=<role>; так выдается
+// роль первому администратору, дальше роли меняются командой admin role
+func (server *Server) handleRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msg := handlers.Msg{
+		Type:     handlers.TypeAdmin,
+		Command:  handlers.AdminRole,
+		Receiver: r.URL.Query().Get("login"),
+		Role:     r.URL.Query().Get("role"),
+	}
+	if err := server.validateAdmin(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	user, err := database.GetUserByLogin(server.DB, msg.Receiver)
+	if err == nil {
+		err = database.SetRole(server.DB, user.Id, msg.Role)
+	}
+	result := database.AuditOk
+	if err != nil {
+		result = database.AuditFailed
+	}
+	server.auditAdmin("http:"+r.RemoteAddr, msg, result)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		server.logger.Error("set role", "user", msg.Receiver, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	server.logger.Info("role set by admin token", "user", msg.Receiver, "role", msg.Role, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
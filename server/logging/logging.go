@@ -0,0 +1,227 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Level slog.Level
+	// писать записи в JSON вместо text формата
+	JSON bool
+	// размер файла в байтах, после которого он ротируется; 0 - без ограничения
+	MaxSize int64
+	// возраст файла, после которого он ротируется; 0 - без ограничения
+	MaxAge time.Duration
+	// сколько старых файлов хранить; 0 - хранить все
+	MaxBackups int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Level:      slog.LevelInfo,
+		MaxSize:    50 << 20,
+		MaxAge:     24 * time.Hour,
+		MaxBackups: 7,
+	}
+}
+
+// New создает логгер компоненты, пишущий в файл path с ротацией
+func New(path string, config Config) (*slog.Logger, io.Closer, error) {
+	file, err := OpenRotatingFile(path, config.MaxSize, config.MaxAge, config.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := &slog.HandlerOptions{Level: config.Level}
+	var handler slog.Handler
+	if config.JSON {
+		handler = slog.NewJSONHandler(file, options)
+	} else {
+		handler = slog.NewTextHandler(file, options)
+	}
+	return slog.New(handler), file, nil
+}
+
+// формат суффикса ротированных файлов; по нему же removeOldBackups отличает
+// свои копии от других файлов с тем же префиксом
+const backupLayout = "20060102-150405.000"
+
+// RotatingFile дописывает в конец существующего файла и переименовывает его
+// в path.<время> при превышении размера или возраста. Время создания файла
+// хранится рядом в path.start, чтобы возраст не сбрасывался перезапуском
+type RotatingFile struct {
+	mutex sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	now func() time.Time
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	err = file.open()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.startTime(info)
+	return nil
+}
+
+// startTime возвращает время создания файла из path.start; для нового файла
+// записывает туда текущее время, для старого файла без отметки - время последней записи
+func (f *RotatingFile) startTime(info os.FileInfo) time.Time {
+	startPath := f.path + ".start"
+	if info.Size() > 0 {
+		data, err := os.ReadFile(startPath)
+		if err == nil {
+			start, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+			if err == nil {
+				return start
+			}
+		}
+	}
+	start := f.now()
+	if info.Size() > 0 {
+		start = info.ModTime()
+	}
+	os.WriteFile(startPath, []byte(start.Format(time.RFC3339Nano)), 0644)
+	return start
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	// файл мог не открыться после прошлой ротации; пробуем снова, чтобы логирование
+	// не остановилось насовсем
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if f.needRotate(int64(len(p))) {
+		rotateErr = f.rotate()
+		// rotate вернул исходный файл, если не смог его переименовать: запись не теряется,
+		// а ротация повторится при следующей записи
+		if f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (f *RotatingFile) needRotate(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && f.now().Sub(f.openedAt) > f.maxAge
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	backup := f.path + "." + f.now().Format(backupLayout)
+	err = os.Rename(f.path, backup)
+	if err != nil {
+		err = fmt.Errorf("rotate %s: %v", f.path, err)
+		if openErr := f.open(); openErr != nil {
+			return fmt.Errorf("%v; reopen: %v", err, openErr)
+		}
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	f.removeOldBackups()
+	return nil
+}
+
+func (f *RotatingFile) removeOldBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(backupLayout, strings.TrimPrefix(name, prefix)); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(f.path), name))
+	}
+	// суффикс - время ротации, поэтому лексикографический порядок совпадает с хронологическим
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
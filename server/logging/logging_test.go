@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestFile открывает файл с подменяемыми часами; clock двигает тест
+func openTestFile(t *testing.T, path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, *time.Time) {
+	t.Helper()
+	file, err := OpenRotatingFile(path, maxSize, maxAge, maxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	clock := time.Now()
+	file.now = func() time.Time { return clock }
+	return file, &clock
+}
+
+func write(t *testing.T, file *RotatingFile, line string) {
+	t.Helper()
+	if _, err := file.Write([]byte(line)); err != nil {
+		t.Fatalf("write %q: %v", line, err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// backups возвращает ротированные копии path по порядку
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".2*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	file, clock := openTestFile(t, path, 10, 0, 0)
+
+	write(t, file, "12345678\n")
+	*clock = clock.Add(time.Second)
+	write(t, file, "abc\n")
+
+	old := backups(t, path)
+	if len(old) != 1 {
+		t.Fatalf("backups = %v, want one", old)
+	}
+	if got := readFile(t, old[0]); got != "12345678\n" {
+		t.Errorf("backup = %q, want the first line", got)
+	}
+	if got := readFile(t, path); got != "abc\n" {
+		t.Errorf("current = %q, want the second line", got)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	file, clock := openTestFile(t, path, 0, time.Hour, 0)
+
+	write(t, file, "a\n")
+	*clock = clock.Add(30 * time.Minute)
+	write(t, file, "b\n")
+	if old := backups(t, path); len(old) != 0 {
+		t.Fatalf("rotated too early: %v", old)
+	}
+	*clock = clock.Add(time.Hour)
+	write(t, file, "c\n")
+	if old := backups(t, path); len(old) != 1 {
+		t.Fatalf("backups = %v, want one", old)
+	}
+	if got := readFile(t, path); got != "c\n" {
+		t.Errorf("current = %q, want the last line", got)
+	}
+}
+
+func TestRotateAgeSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	file, _ := openTestFile(t, path, 0, time.Hour, 0)
+	write(t, file, "a\n")
+	file.Close()
+
+	// после перезапуска возраст считается от создания файла, а не от открытия
+	file, clock := openTestFile(t, path, 0, time.Hour, 0)
+	*clock = clock.Add(2 * time.Hour)
+	write(t, file, "b\n")
+	if old := backups(t, path); len(old) != 1 {
+		t.Fatalf("backups = %v, want one", old)
+	}
+}
+
+func TestRotatePrunesBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	other := filepath.Join(dir, "app.log.old")
+	if err := os.WriteFile(other, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, clock := openTestFile(t, path, 2, 0, 2)
+
+	for i := 0; i < 5; i++ {
+		*clock = clock.Add(time.Second)
+		write(t, file, "x\n")
+	}
+	if old := backups(t, path); len(old) != 2 {
+		t.Errorf("backups = %v, want two", old)
+	}
+	for _, keep := range []string{other, path + ".start"} {
+		if _, err := os.Stat(keep); err != nil {
+			t.Errorf("%s was removed: %v", keep, err)
+		}
+	}
+}
+
+func TestRotateFailureKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	file, clock := openTestFile(t, path, 2, 0, 0)
+	write(t, file, "a\n")
+
+	// каталог на месте копии не дает переименовать файл
+	*clock = clock.Add(time.Second)
+	blocker := path + "." + clock.Format(backupLayout)
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blocker, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := file.Write([]byte("b\n"))
+	if err == nil {
+		t.Error("write succeeded, want the rotation error")
+	}
+	if n != 2 {
+		t.Errorf("written = %d, want the record kept in the current file", n)
+	}
+
+	*clock = clock.Add(time.Second)
+	write(t, file, "c\n")
+	old := backups(t, path)
+	if len(old) != 2 || readFile(t, path) != "c\n" {
+		t.Fatalf("backups = %v, current = %q; want rotation to recover", old, readFile(t, path))
+	}
+	if got := readFile(t, old[1]); !strings.HasPrefix(got, "a\nb\n") {
+		t.Errorf("backup = %q, want both lines written before the retry", got)
+	}
+}
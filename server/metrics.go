@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	ConnectedClients prometheus.Gauge
+	Logins           *prometheus.CounterVec
+
+	MessagesProduced  prometheus.Counter
+	MessagesConsumed  prometheus.Counter
+	MessagesPersisted prometheus.Counter
+
+	KafkaProduceLatency prometheus.Histogram
+	KafkaProduceErrors  prometheus.Counter
+
+	DBQueryDuration *prometheus.HistogramVec
+
+	Throttled *prometheus.CounterVec
+}
+
+func NewMetrics(server *Server) *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		ConnectedClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gochat_connected_clients",
+			Help: "Number of authenticated clients currently connected.",
+		}),
+		Logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochat_logins_total",
+			Help: "Login attempts by result.",
+		}, []string{"result"}),
+		MessagesProduced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochat_messages_produced_total",
+			Help: "Chat messages sent to Kafka.",
+		}),
+		MessagesConsumed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochat_messages_consumed_total",
+			Help: "Chat messages read from Kafka.",
+		}),
+		MessagesPersisted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochat_messages_persisted_total",
+			Help: "Chat messages stored in the database.",
+		}),
+		KafkaProduceLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gochat_kafka_produce_latency_seconds",
+			Help:    "Time from Produce to delivery report.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		KafkaProduceErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gochat_kafka_produce_errors_total",
+			Help: "Messages that failed to be delivered to Kafka.",
+		}),
+		DBQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gochat_db_query_duration_seconds",
+			Help:    "Database query latency by query.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"query"}),
+		Throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gochat_throttled_total",
+			Help: "Requests rejected by rate limits by kind.",
+		}, []string{"kind"}),
+	}
+
+	metrics.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metrics.ConnectedClients,
+		metrics.Logins,
+		metrics.MessagesProduced,
+		metrics.MessagesConsumed,
+		metrics.MessagesPersisted,
+		metrics.KafkaProduceLatency,
+		metrics.KafkaProduceErrors,
+		metrics.DBQueryDuration,
+		metrics.Throttled,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gochat_dropped_frames_total",
+			Help: "Outbound frames dropped because a client send queue was full.",
+		}, func() float64 { return float64(server.queueStats.Dropped.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gochat_spilled_frames_total",
+			Help: "Outbound frames moved to a connection spill buffer.",
+		}, func() float64 { return float64(server.queueStats.Spilled.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gochat_slow_consumers_disconnected_total",
+			Help: "Connections closed because the client did not read fast enough.",
+		}, func() float64 { return float64(server.queueStats.Disconnected.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "gochat_offline_frames_total",
+			Help: "Outbound frames saved to the offline queue for delivery on next login.",
+		}, func() float64 { return float64(server.queueStats.Persisted.Load()) }),
+		&queueDepthCollector{server: server},
+	)
+	return metrics
+}
+
+func (metrics *Metrics) ObserveDBQuery(query string, duration time.Duration) {
+	metrics.DBQueryDuration.WithLabelValues(query).Observe(duration.Seconds())
+}
+
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// queueDepthCollector на каждый сбор метрик обходит открытые соединения
+// и строит распределение глубины их очередей отправки
+type queueDepthCollector struct {
+	server *Server
+}
+
+var (
+	queueDepthDesc = prometheus.NewDesc("gochat_send_queue_depth",
+		"Distribution of per-connection send queue depth.", nil, nil)
+	queueDepthBuckets = []float64{0, 1, 4, 16, 64, 256, 1024, 4096}
+)
+
+func (collector *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (collector *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	server := collector.server
+	buckets := make(map[float64]uint64, len(queueDepthBuckets))
+	var count uint64
+	var sum float64
+
+	// снимок вместо server.mutex: сбор метрик не должен ждать обработку сообщений
+	var connections []*Connection
+	if snapshot := server.connectionsSnapshot.Load(); snapshot != nil {
+		connections = *snapshot
+	}
+	for _, connection := range connections {
+		depth := float64(connection.QueueDepth())
+		count++
+		sum += depth
+		for _, bound := range queueDepthBuckets {
+			if depth <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstHistogram(queueDepthDesc, count, sum, buckets)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/handlers"
+	"server/moderation"
+)
+
+var errRejected = errors.New("message rejected by content filter")
+
+// moderate прогоняет текст сообщения через фильтры и пишет в лог сработавшие правила
+func (server *Server) moderate(msg handlers.Msg) moderation.Result {
+	result := server.moderation.Run(moderation.Message{Sender: msg.Sender, Receiver: msg.Receiver, Text: msg.Text})
+	if result.Action != moderation.Allow {
+		server.logger.Info("content filter", "user", msg.Sender, "receiver", msg.Receiver,
+			"action", result.Action.String(), "rules", strings.Join(result.Rules, ","))
+	}
+	return result
+}
+
+// flag отправляет сохраненное сообщение на проверку модераторам; вызывать под server.mutex
+func (server *Server) flag(msgID int, result moderation.Result) {
+	err := database.FlagMsg(server.DB, msgID, "filter: "+strings.Join(result.Rules, ", "))
+	if err != nil {
+		server.logger.Error("flag message", "message_id", msgID, "error", err)
+	}
+}
+
+// report сохраняет жалобу пользователя на сообщение собеседника
+func (server *Server) report(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	server.mutex.Lock()
+	err := database.AddReport(server.DB, msg.ID, user.Id, msg.Text)
+	server.mutex.Unlock()
+	if err != nil {
+		server.logger.Info("report message", "user", user.Login, "message_id", msg.ID, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	server.logger.Info("message reported", "user", user.Login, "message_id", msg.ID)
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypeReport,
+		ID:        msg.ID,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      "report sent to moderators",
+	})
+}
@@ -0,0 +1,76 @@
+package moderation
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// WordList срабатывает на целые слова из списка без учета регистра
+type WordList struct {
+	name   string
+	words  map[string]bool
+	action Action
+}
+
+func NewWordList(name string, words []string, action Action) *WordList {
+	list := &WordList{name: name, words: make(map[string]bool, len(words)), action: action}
+	for _, word := range words {
+		list.words[strings.ToLower(word)] = true
+	}
+	return list
+}
+
+func (list *WordList) Check(msg Message) Decision {
+	found := false
+	var masked strings.Builder
+	// слово - непрерывная последовательность букв и цифр
+	isWordRune := func(c rune) bool { return unicode.IsLetter(c) || unicode.IsDigit(c) }
+	text := msg.Text
+	for len(text) > 0 {
+		start := strings.IndexFunc(text, isWordRune)
+		if start < 0 {
+			masked.WriteString(text)
+			break
+		}
+		masked.WriteString(text[:start])
+		text = text[start:]
+		end := strings.IndexFunc(text, func(c rune) bool { return !isWordRune(c) })
+		if end < 0 {
+			end = len(text)
+		}
+		word := text[:end]
+		if list.words[strings.ToLower(word)] {
+			found = true
+			word = mask(word)
+		}
+		masked.WriteString(word)
+		text = text[end:]
+	}
+	if !found {
+		return Decision{Action: Allow}
+	}
+	return Decision{Action: list.action, Text: masked.String(), Rule: list.name}
+}
+
+// Regex срабатывает на совпадения регулярного выражения
+type Regex struct {
+	name   string
+	re     *regexp.Regexp
+	action Action
+}
+
+func NewRegex(name string, pattern string, action Action) (*Regex, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Regex{name: name, re: re, action: action}, nil
+}
+
+func (r *Regex) Check(msg Message) Decision {
+	if !r.re.MatchString(msg.Text) {
+		return Decision{Action: Allow}
+	}
+	return Decision{Action: r.action, Text: r.re.ReplaceAllStringFunc(msg.Text, mask), Rule: r.name}
+}
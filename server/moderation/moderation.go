@@ -0,0 +1,202 @@
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Action - что сделать с сообщением; значения упорядочены по строгости
+type Action int
+
+const (
+	// пропустить без изменений
+	Allow Action = iota
+	// доставить и отправить модераторам на проверку
+	Flag
+	// заменить совпадения звездочками и доставить
+	Mask
+	// не сохранять и вернуть отправителю ошибку
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Mask:
+		return "mask"
+	case Reject:
+		return "reject"
+	default:
+		return "allow"
+	}
+}
+
+// ParseAction разбирает действие из конфигурации
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "flag":
+		return Flag, nil
+	case "mask":
+		return Mask, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Allow, fmt.Errorf("unknown moderation action %q", s)
+}
+
+// Message - то, что видят фильтры
+type Message struct {
+	Sender   string
+	Receiver string
+	Text     string
+}
+
+// Decision - решение одного фильтра; Text - текст после маскирования для Action == Mask,
+// пустой Text при Mask означает, что маскируется весь текст
+type Decision struct {
+	Action Action
+	Text   string
+	Rule   string
+}
+
+// Filter проверяет сообщение; фильтры без совпадений возвращают Allow
+type Filter interface {
+	Check(msg Message) Decision
+}
+
+// FilterFunc - хук на Go, например вызов внешнего сервиса модерации
+type FilterFunc func(msg Message) Decision
+
+func (f FilterFunc) Check(msg Message) Decision {
+	return f(msg)
+}
+
+// Result - итог прогона через все фильтры
+type Result struct {
+	// самое строгое из сработавших действий
+	Action Action
+	// текст с учетом маскирования
+	Text string
+	// имена сработавших правил по порядку
+	Rules []string
+	// хотя бы одно правило требует проверки модератором
+	Flagged bool
+}
+
+// Pipeline прогоняет сообщение через фильтры по порядку: каждый следующий видит
+// текст, замаскированный предыдущими, а Reject останавливает проверку
+type Pipeline struct {
+	filters []Filter
+}
+
+func NewPipeline(filters ...Filter) *Pipeline {
+	return &Pipeline{filters: filters}
+}
+
+// New собирает конвейер из правил конфигурации, после которых идут хуки
+func New(config Config) (*Pipeline, error) {
+	pipeline := NewPipeline()
+	for _, rule := range config.Rules {
+		filter, err := rule.filter()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Add(filter)
+	}
+	for _, hook := range config.Hooks {
+		pipeline.Add(hook)
+	}
+	return pipeline, nil
+}
+
+// Add добавляет фильтр в конец; вызывать до начала обработки сообщений
+func (p *Pipeline) Add(filter Filter) {
+	p.filters = append(p.filters, filter)
+}
+
+func (p *Pipeline) Run(msg Message) Result {
+	result := Result{Action: Allow, Text: msg.Text}
+	for _, filter := range p.filters {
+		msg.Text = result.Text
+		decision := filter.Check(msg)
+		if decision.Action == Allow {
+			continue
+		}
+		result.Rules = append(result.Rules, decision.Rule)
+		if decision.Action > result.Action {
+			result.Action = decision.Action
+		}
+		if decision.Action == Flag {
+			result.Flagged = true
+		}
+		if decision.Action == Mask {
+			if decision.Text == "" {
+				decision.Text = mask(msg.Text)
+			}
+			result.Text = decision.Text
+		}
+		if decision.Action == Reject {
+			break
+		}
+	}
+	return result
+}
+
+// Config - правила фильтрации; пустая конфигурация пропускает все сообщения
+type Config struct {
+	Rules []Rule
+	// хуки выполняются после правил
+	Hooks []Filter
+}
+
+// Rule - список слов (Words) или регулярное выражение (Pattern) с действием "reject", "mask" или "flag"
+type Rule struct {
+	Name    string   `json:"name"`
+	Words   []string `json:"words,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Action  string   `json:"action"`
+}
+
+// LoadRules читает правила из JSON файла со списком Rule и проверяет их
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, rule := range rules {
+		if _, err := rule.filter(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return rules, nil
+}
+
+func (rule Rule) filter() (Filter, error) {
+	action, err := ParseAction(rule.Action)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+	}
+	if (len(rule.Words) == 0) == (rule.Pattern == "") {
+		return nil, fmt.Errorf("rule %q: exactly one of words and pattern must be set", rule.Name)
+	}
+	if rule.Pattern != "" {
+		filter, err := NewRegex(rule.Name, rule.Pattern, action)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		return filter, nil
+	}
+	return NewWordList(rule.Name, rule.Words, action), nil
+}
+
+// mask заменяет каждый символ совпадения звездочкой, сохраняя длину в символах
+func mask(s string) string {
+	return strings.Repeat("*", len([]rune(s)))
+}
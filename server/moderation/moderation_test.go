@@ -0,0 +1,116 @@
+package moderation
+
+import (
+	"reflect"
+	"testing"
+)
+
+// hook - фильтр с заранее заданным решением
+func hook(rule string, action Action, text string) Filter {
+	return FilterFunc(func(msg Message) Decision {
+		return Decision{Action: action, Text: text, Rule: rule}
+	})
+}
+
+func TestPipelineOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []Filter
+		text    string
+		want    Result
+	}{
+		{
+			name:    "no filters",
+			filters: nil,
+			text:    "hello",
+			want:    Result{Action: Allow, Text: "hello"},
+		},
+		{
+			name:    "mask then flag",
+			filters: []Filter{NewWordList("words", []string{"bad"}, Mask), NewWordList("review", []string{"money"}, Flag)},
+			text:    "bad money",
+			want:    Result{Action: Mask, Text: "*** money", Rules: []string{"words", "review"}, Flagged: true},
+		},
+		{
+			name:    "flag then mask",
+			filters: []Filter{NewWordList("review", []string{"money"}, Flag), NewWordList("words", []string{"bad"}, Mask)},
+			text:    "bad money",
+			want:    Result{Action: Mask, Text: "*** money", Rules: []string{"review", "words"}, Flagged: true},
+		},
+		{
+			name: "reject stops the pipeline",
+			filters: []Filter{
+				NewWordList("review", []string{"money"}, Flag),
+				NewWordList("spam", []string{"casino"}, Reject),
+				NewWordList("words", []string{"bad"}, Mask),
+			},
+			text: "bad money casino",
+			want: Result{Action: Reject, Text: "bad money casino", Rules: []string{"review", "spam"}, Flagged: true},
+		},
+		{
+			name:    "mask hides a word from later filters",
+			filters: []Filter{NewWordList("words", []string{"casino"}, Mask), NewWordList("spam", []string{"casino"}, Reject)},
+			text:    "casino",
+			want:    Result{Action: Mask, Text: "******", Rules: []string{"words"}},
+		},
+		{
+			name:    "flag after reject is not reached",
+			filters: []Filter{NewWordList("spam", []string{"casino"}, Reject), NewWordList("review", []string{"casino"}, Flag)},
+			text:    "casino",
+			want:    Result{Action: Reject, Text: "casino", Rules: []string{"spam"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewPipeline(test.filters...).Run(Message{Text: test.text})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Run(%q) = %+v, want %+v", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWordListIgnoresCase(t *testing.T) {
+	list := NewWordList("words", []string{"Bad", "плохо"}, Mask)
+	tests := []struct {
+		text   string
+		action Action
+		masked string
+	}{
+		{"bad", Mask, "***"},
+		{"BAD day", Mask, "*** day"},
+		{"so, bAd!", Mask, "so, ***!"},
+		{"ПЛОХО", Mask, "*****"},
+		{"badge", Allow, ""},
+		{"not bad1", Allow, ""},
+		{"", Allow, ""},
+	}
+	for _, test := range tests {
+		decision := list.Check(Message{Text: test.text})
+		if decision.Action != test.action || decision.Text != test.masked {
+			t.Errorf("Check(%q) = %v %q, want %v %q", test.text, decision.Action, decision.Text, test.action, test.masked)
+		}
+	}
+}
+
+func TestMaskWithEmptyText(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		text   string
+		want   string
+	}{
+		{"hook without text masks everything", hook("hook", Mask, ""), "secret", "******"},
+		{"hook text is used as is", hook("hook", Mask, "[removed]"), "secret", "[removed]"},
+		{"empty message", hook("hook", Mask, ""), "", ""},
+		{"empty message through word list", NewWordList("words", []string{"bad"}, Mask), "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NewPipeline(test.filter).Run(Message{Text: test.text})
+			if got.Text != test.want {
+				t.Errorf("Run(%q).Text = %q, want %q", test.text, got.Text, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"server/database"
+	"server/handlers"
+)
+
+// offlineTypes - события, которые при политике spill переносятся в офлайн очередь;
+// сообщения чата туда не попадают, их и так досылает история при входе
+var offlineTypes = map[string]bool{
+	handlers.TypeEdit:         true,
+	handlers.TypeDelete:       true,
+	handlers.TypeReact:        true,
+	handlers.TypeUnreact:      true,
+	handlers.TypeAnnouncement: true,
+}
+
+func offlineFrame(frame []byte) bool {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &head) != nil {
+		return false
+	}
+	return offlineTypes[head.Type]
+}
+
+// saveOffline сохраняет подходящие кадры в офлайн очередь пользователя; вызывать под server.mutex
+func (server *Server) saveOffline(userID int, frames [][]byte, logger *slog.Logger) {
+	saved := make([][]byte, 0, len(frames))
+	for _, frame := range frames {
+		if offlineFrame(frame) {
+			saved = append(saved, frame)
+		}
+	}
+	if len(saved) == 0 {
+		return
+	}
+	err := database.AddOfflineFrames(server.DB, userID, saved)
+	if err != nil {
+		logger.Error("save offline frames", "count", len(saved), "error", err)
+		return
+	}
+	server.queueStats.Persisted.Add(int64(len(saved)))
+	logger.Info("frames moved to offline queue", "count", len(saved))
+}
+
+// saveUnsent забирает у закрытого соединения все, что не успели отправить; вызывать под server.mutex
+func (server *Server) saveUnsent(connection *Connection, userID int, logger *slog.Logger) {
+	if server.config.OverflowPolicy != OverflowSpill {
+		return
+	}
+	connection.Close()
+	server.saveOffline(userID, connection.Unsent(), logger)
+}
+
+// deliverOffline кладет событие в офлайн очередь, если соединение уже закрыто; вызывать под server.mutex
+func (server *Server) deliverOffline(connection *Connection, user *handlers.User, data interface{}, err error) bool {
+	if server.config.OverflowPolicy != OverflowSpill || !errors.Is(err, ErrConnectionClosed) || connection.accountDeleted {
+		return false
+	}
+	frame, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+	server.saveOffline(user.Id, [][]byte{frame}, server.logger.With("user", user.Login))
+	return true
+}
+
+// replayOffline досылает накопленные события после истории; очередь забирается
+// под мьютексом, а отправляется без него
+func (server *Server) replayOffline(connection *Connection, user *handlers.User, logger *slog.Logger) error {
+	server.mutex.Lock()
+	frames, err := database.TakeOfflineFrames(server.DB, user.Id)
+	server.mutex.Unlock()
+	if err != nil {
+		logger.Error("take offline frames", "error", err)
+		return nil
+	}
+	for i, frame := range frames {
+		err = connection.SendWait(json.RawMessage(frame))
+		if err != nil {
+			// недоставленный остаток вернется при следующем входе
+			server.mutex.Lock()
+			server.saveOffline(user.Id, frames[i:], logger)
+			server.mutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"server/database"
+	"server/handlers"
+)
+
+// profile отвечает профилем пользователя msg.Receiver или меняет свой профиль
+func (server *Server) profile(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if msg.Type == handlers.TypeProfileUpdate {
+		err := database.UpdateProfile(server.DB, user.Id, *msg.Profile)
+		if err != nil {
+			server.logger.Error("update profile", "user", user.Login, "error", err)
+			connection.Send(errorMsg(msg, err))
+			return
+		}
+		server.logger.Info("profile updated", "user", user.Login)
+		msg.Receiver = ""
+	}
+
+	target := user
+	if msg.Receiver != "" && msg.Receiver != user.Login {
+		var err error
+		target, err = database.GetUserByLogin(server.DB, msg.Receiver)
+		if err == sql.ErrNoRows {
+			connection.Send(handlers.Msg{Type: handlers.TypeError, Receiver: msg.Receiver, Timestamp: time.Now().UnixMilli(),
+				Text: "user not found", Status: 1, Code: "user_not_found"})
+			return
+		}
+		if err != nil {
+			server.logger.Error("get user", "user", msg.Receiver, "error", err)
+			connection.Send(errorMsg(msg, err))
+			return
+		}
+	}
+	profile, err := server.visibleProfile(user, target)
+	if err != nil {
+		server.logger.Error("get profile", "user", target.Login, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypeProfile,
+		Receiver:  target.Login,
+		Timestamp: time.Now().UnixMilli(),
+		Profile:   profile,
+	})
+}
+
+// visibleProfile возвращает профиль target так, как его видит viewer: тем, кого
+// target заблокировал, виден только логин; вызывать под server.mutex
+func (server *Server) visibleProfile(viewer *handlers.User, target *handlers.User) (*handlers.Profile, error) {
+	profile, err := database.GetProfile(server.DB, target.Id)
+	if err != nil {
+		return nil, err
+	}
+	if viewer.Id != target.Id {
+		blocked, err := database.IsBlockedBy(server.DB, viewer.Id, target.Id)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return &handlers.Profile{Login: profile.Login}, nil
+		}
+	}
+	profile.Avatar = publicAttachment(profile.Avatar)
+	return profile, nil
+}
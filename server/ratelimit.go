@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter хранит отдельный token bucket на каждый ключ (логин или IP)
+type keyedLimiter struct {
+	mutex    sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(perSecond float64, burst int) *keyedLimiter {
+	return &keyedLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+func (l *keyedLimiter) Allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter.Allow()
+}
+
+// forget удаляет ключи, которые не использовались дольше idle
+func (l *keyedLimiter) forget(idle time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, entry := range l.limiters {
+		if time.Since(entry.lastSeen) > idle {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+type RateLimits struct {
+	messages    *keyedLimiter
+	typing      *keyedLimiter
+	connections *keyedLimiter
+	auth        *keyedLimiter
+
+	mutex         sync.Mutex
+	maxConnsPerIP int
+	connsPerIP    map[string]int
+}
+
+func NewRateLimits(config Config) *RateLimits {
+	return &RateLimits{
+		messages:      newKeyedLimiter(config.MessagesPerSecond, config.MessagesBurst),
+		typing:        newKeyedLimiter(config.TypingPerSecond, config.TypingBurst),
+		connections:   newKeyedLimiter(config.ConnectionsPerSecondPerIP, config.ConnectionsBurstPerIP),
+		auth:          newKeyedLimiter(config.AuthAttemptsPerSecondPerIP, config.AuthAttemptsBurstPerIP),
+		maxConnsPerIP: config.MaxConnectionsPerIP,
+		connsPerIP:    make(map[string]int),
+	}
+}
+
+func (limits *RateLimits) AllowMessage(login string) bool {
+	return limits.messages.Allow(login)
+}
+
+func (limits *RateLimits) AllowTyping(login string) bool {
+	return limits.typing.Allow(login)
+}
+
+func (limits *RateLimits) AllowAuth(ip string) bool {
+	return limits.auth.Allow(ip)
+}
+
+// AcquireConnection учитывает новое соединение с ip; при успехе его нужно
+// освободить через ReleaseConnection
+func (limits *RateLimits) AcquireConnection(ip string) bool {
+	if !limits.connections.Allow(ip) {
+		return false
+	}
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	if limits.maxConnsPerIP > 0 && limits.connsPerIP[ip] >= limits.maxConnsPerIP {
+		return false
+	}
+	limits.connsPerIP[ip]++
+	return true
+}
+
+func (limits *RateLimits) ReleaseConnection(ip string) {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	limits.connsPerIP[ip]--
+	if limits.connsPerIP[ip] <= 0 {
+		delete(limits.connsPerIP, ip)
+	}
+}
+
+// Cleanup периодически забывает неактивные ключи, чтобы таблицы не росли бесконечно
+func (limits *RateLimits) Cleanup(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			limits.messages.forget(10 * time.Minute)
+			limits.typing.forget(10 * time.Minute)
+			limits.connections.forget(10 * time.Minute)
+			limits.auth.forget(10 * time.Minute)
+		case <-done:
+			return
+		}
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
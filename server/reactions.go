@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"server/database"
+	"server/handlers"
+)
+
+// processReaction ставит или снимает реакцию и рассылает участникам новые счетчики; вызывать под server.mutex
+func (server *Server) processReaction(ctx context.Context, msgJSON handlers.Msg) {
+	user, err := server.frameUser(ctx, msgJSON.SenderID, msgJSON.Sender)
+	if err != nil {
+		server.logger.Warn("sender not found", "user", msgJSON.Sender, "user_id", msgJSON.SenderID)
+		return
+	}
+
+	// реакция видна собеседнику, поэтому проверяется так же, как новое сообщение
+	err = server.checkPeer(ctx, user, msgJSON.ID)
+	if err != nil {
+		server.logger.Info("reaction not allowed", "user", user.Login, "message_id", msgJSON.ID, "error", err)
+		server.deliver(user, errorMsg(msgJSON, err))
+		return
+	}
+
+	var dbMsg *handlers.DataBaseMsg
+	if msgJSON.Type == handlers.TypeReact {
+		err = traceDB(ctx, "add_reaction", func() (err error) {
+			dbMsg, err = database.AddReaction(server.DB, msgJSON.ID, user.Id, msgJSON.Emoji)
+			return err
+		})
+	} else {
+		err = traceDB(ctx, "remove_reaction", func() (err error) {
+			dbMsg, err = database.RemoveReaction(server.DB, msgJSON.ID, user.Id, msgJSON.Emoji)
+			return err
+		})
+	}
+	if err != nil {
+		server.logger.Info("reaction", "user", user.Login, "message_id", msgJSON.ID, "error", err)
+		server.deliver(user, errorMsg(msgJSON, err))
+		return
+	}
+
+	user1, user2, err := database.GetUsersByConversaionId(server.DB, dbMsg.ConversationId)
+	if err != nil {
+		server.logger.Error("get conversation users", "conversation_id", dbMsg.ConversationId, "error", err)
+		return
+	}
+	// отправитель события - тот, кто поставил реакцию, а не автор сообщения
+	event := handlers.Msg{
+		Type:      msgJSON.Type,
+		Sender:    user.Login,
+		Receiver:  user1.Login,
+		Timestamp: msgJSON.Timestamp,
+		ID:        dbMsg.ID,
+		Seq:       dbMsg.Seq,
+		Emoji:     msgJSON.Emoji,
+		Reactions: dbMsg.Reactions,
+	}
+	if user1.Id == user.Id {
+		event.Receiver = user2.Login
+	}
+	server.deliverToPair(ctx, user, user1, user2, event)
+}
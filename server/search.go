@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"server/database"
+	"server/handlers"
+)
+
+// search ищет по истории пользователя и отвечает одним кадром search_results
+func (server *Server) search(connection *Connection, user *handlers.User, msg handlers.Msg) {
+	query := database.SearchQuery{Text: msg.Text}
+	if msg.Since != 0 {
+		query.Since = time.UnixMilli(msg.Since)
+	}
+	if msg.Until != 0 {
+		query.Until = time.UnixMilli(msg.Until)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if msg.Receiver != "" {
+		peer, err := database.GetUserByLogin(server.DB, msg.Receiver)
+		if err == sql.ErrNoRows {
+			// с несуществующим пользователем переписки нет, значит и найти нечего
+			connection.Send(handlers.Msg{Type: handlers.TypeSearchResults, Sender: user.Login, Receiver: msg.Receiver,
+				Timestamp: time.Now().UnixMilli(), Text: msg.Text})
+			return
+		}
+		if err != nil {
+			server.logger.Error("get user", "user", msg.Receiver, "error", err)
+			connection.Send(errorMsg(msg, err))
+			return
+		}
+		query.PeerID = peer.Id
+	}
+	dbMsgs, err := database.SearchMsgs(server.DB, user.Id, query)
+	if err != nil {
+		server.logger.Info("search", "user", user.Login, "error", err)
+		connection.Send(errorMsg(msg, err))
+		return
+	}
+
+	results := make([]handlers.Msg, 0, len(dbMsgs))
+	users := make(map[int][2]*handlers.User)
+	for _, dbMsg := range dbMsgs {
+		pair, ok := users[dbMsg.ConversationId]
+		if !ok {
+			user1, user2, err := database.GetUsersByConversaionId(server.DB, dbMsg.ConversationId)
+			if err != nil {
+				server.logger.Error("get conversation users", "conversation_id", dbMsg.ConversationId, "error", err)
+				continue
+			}
+			pair = [2]*handlers.User{user1, user2}
+			users[dbMsg.ConversationId] = pair
+		}
+		results = append(results, msgFromDB(dbMsg, pair[0], pair[1]))
+	}
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypeSearchResults,
+		Sender:    user.Login,
+		Receiver:  msg.Receiver,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      msg.Text,
+		Results:   results,
+	})
+}
@@ -2,19 +2,35 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"server/blobstore"
 	"server/database"
 	"server/handlers"
+	"server/logging"
+	"server/moderation"
 	"server/utility"
+	"server/validation"
 
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
@@ -24,36 +40,59 @@ type Server struct {
 	tcpServer *TCPServer
 	mutex     sync.Mutex
 
-	logger     *log.Logger
-	loggerFile *os.File
+	logger     *slog.Logger
+	loggerFile io.Closer
 
 	kafkaProducer         *kafka.Producer
 	kafkaMsgTopic         string
 	kafkaBootstrapServers string
+	// при остановке берется на запись: после Flush в kafka уже ничего не пишется
+	produceMutex sync.RWMutex
+	stopping     bool
+
+	config     Config
+	metrics    *Metrics
+	health     Health
+	// останавливает экспорт трейсов, досылая накопленные спаны
+	tracingShutdown func(context.Context) error
+	httpServer *http.Server
+	queueStats QueueStats
+	limits     *RateLimits
+	authGuard  *AuthGuard
+	lastConnId atomic.Int64
+	startedAt  time.Time
+
+	blobs      blobstore.Store
+	moderation *moderation.Pipeline
 
 	DB    *sql.DB
-	Conns map[int]net.Conn
+	Conns map[int]*Connection
+	// все открытые соединения, включая еще не прошедшие авторизацию
+	connections map[int64]*Connection
+	// копия connections для сбора метрик без server.mutex; обновляется вместе с connections
+	connectionsSnapshot atomic.Pointer[[]*Connection]
 }
 
-func NewServer(domain string, port int, kafkaBootstrapServers string, kafkaMsgTopic string, dataSourceName string) (*Server, error) {
-	logger := log.Default()
-	err := os.Mkdir("logs", 0666)
-	if err != nil && err.(*os.PathError).Err.Error() != "file exists" {
+func NewServer(domain string, port int, kafkaBootstrapServers string, kafkaMsgTopic string, dataSourceName string, config Config) (*Server, error) {
+	logger, f, err := logging.New(filepath.Join(config.LogDir, "server.log"), config.Log)
+	if err != nil {
 		return nil, err
 	}
-	f, err := os.Create("logs/server.log")
+	logger = logger.With("component", "server")
+
+	tcpServer, err := NewTCPServer(domain, port, config)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	tcpServer, err := NewTCPServer(domain, port)
+	tracingShutdown, err := InitTracing(config)
 	if err != nil {
 		f.Close()
+		tcpServer.Close()
 		return nil, err
 	}
 
-	logger.SetOutput(f)
-
 	producer, err := kafka.NewProducer(&kafka.ConfigMap{
 		"bootstrap.servers": kafkaBootstrapServers,
 	})
@@ -65,156 +104,455 @@ func NewServer(domain string, port int, kafkaBootstrapServers string, kafkaMsgTo
 
 	DB, err := database.InitDb(dataSourceName)
 	if err != nil {
-		logger.Println("error in init db: " + err.Error())
+		logger.Error("error in init db", "error", err)
+		f.Close()
+		tcpServer.Close()
+		producer.Close()
+		return nil, err
+	}
+	logger.Info("database init successful")
+
+	blobs, err := blobstore.New(context.Background(), config.Blob)
+	if err != nil {
+		logger.Error("error in init blob store", "error", err)
+		f.Close()
+		tcpServer.Close()
+		producer.Close()
+		DB.Close()
+		return nil, err
+	}
+
+	filters, err := moderation.New(config.Moderation)
+	if err != nil {
+		logger.Error("error in init moderation", "error", err)
 		f.Close()
 		tcpServer.Close()
 		producer.Close()
+		DB.Close()
 		return nil, err
 	}
-	logger.Println("database init successful")
 
 	server := &Server{
 		logger:                logger,
 		loggerFile:            f,
 		tcpServer:             tcpServer,
+		tracingShutdown:       tracingShutdown,
 		kafkaProducer:         producer,
 		kafkaMsgTopic:         kafkaMsgTopic,
 		kafkaBootstrapServers: kafkaBootstrapServers,
+		config:                config,
+		startedAt:             time.Now(),
+		limits:                NewRateLimits(config),
+		authGuard:             NewAuthGuard(config),
+		blobs:                 blobs,
+		moderation:            filters,
 		DB:                    DB,
-		Conns:                 make(map[int]net.Conn),
+		Conns:                 make(map[int]*Connection),
+		connections:           make(map[int64]*Connection),
 	}
+	server.metrics = NewMetrics(server)
+	database.QueryObserver = server.metrics.ObserveDBQuery
 
 	err = database.RunMigrations(server.DB)
 	if err != nil {
-		logger.Println("error in runMigrationsL: " + err.Error())
+		logger.Error("error in run migrations", "error", err)
 		return nil, err
 	}
+
+	// после аварийной остановки в базе могли остаться пользователи online
+	err = database.SetAllUsersOffline(server.DB)
+	if err != nil {
+		logger.Error("reset online users", "error", err)
+	}
 	return server, nil
 }
 
-func (server *Server) ConsumerWorkMsgsTopic() {
+func (server *Server) ConsumerWorkMsgsTopic(ctx context.Context) {
 	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
 		"bootstrap.servers": server.kafkaBootstrapServers,
 		"group.id":          "myGroup",
 		"auto.offset.reset": "latest",
 	})
 	if err != nil {
-		server.logger.Fatal(err)
-		return
+		server.logger.Error("kafka consumer init", "error", err)
+		os.Exit(1)
 	}
-	server.logger.Println("Kafka consumer init")
+	server.logger.Info("Kafka consumer init")
 	defer consumer.Close()
 
 	if err := consumer.SubscribeTopics([]string{server.kafkaMsgTopic}, nil); err != nil {
-		server.logger.Fatal(err)
+		server.logger.Error("kafka subscribe", "topic", server.kafkaMsgTopic, "error", err)
 		consumer.Close()
-		return
+		os.Exit(1)
 	}
 
+	// после отмены ctx дочитываем топик, пока он не опустеет, но не дольше KafkaFlushTimeout
+	var drainUntil time.Time
 	for {
+		if ctx.Err() != nil {
+			if drainUntil.IsZero() {
+				drainUntil = time.Now().Add(server.config.KafkaFlushTimeout)
+			} else if time.Now().After(drainUntil) {
+				server.logger.Warn("kafka consumer: drain timeout")
+				return
+			}
+		}
 		msg, err := consumer.ReadMessage(time.Second)
 		if err != nil {
-			//server.logger.Println("consumer: " + err.Error())
+			//server.logger.Debug("consumer", "error", err)
+			if ctx.Err() != nil {
+				return
+			}
 			continue
 		}
+		server.metrics.MessagesConsumed.Inc()
+
+		msgCtx, span := tracer.Start(extractKafkaHeaders(context.Background(), msg), "kafka.consume",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attribute.String("messaging.destination.name", server.kafkaMsgTopic)))
 
 		var msgJSON handlers.Msg
 		err = json.Unmarshal(msg.Value, &msgJSON)
 		if err != nil {
-			server.logger.Println(err.Error())
+			server.logger.Warn("bad message in kafka", "error", err)
+			span.RecordError(err)
+			span.End()
 			continue
 		}
 		server.mutex.Lock()
+		server.processMsg(msgCtx, msgJSON)
+		server.mutex.Unlock()
+		span.End()
+	}
+}
 
-		userReceiver, err := database.GetUserByLogin(server.DB, msgJSON.Receiver)
+// processMsg обрабатывает сообщение из kafka; вызывать под server.mutex
+func (server *Server) processMsg(ctx context.Context, msgJSON handlers.Msg) {
+	switch msgJSON.Type {
+	case handlers.TypeEdit:
+		server.processEdit(ctx, msgJSON)
+	case handlers.TypeDelete:
+		server.processDelete(ctx, msgJSON)
+	case handlers.TypeReact, handlers.TypeUnreact:
+		server.processReaction(ctx, msgJSON)
+	default:
+		server.processChatMsg(ctx, msgJSON)
+	}
+}
 
-		if err == nil {
-			userSender, err := database.GetUserByLogin(server.DB, msgJSON.Sender)
-			if err != nil {
-				server.logger.Println("user " + msgJSON.Sender + " not found")
-			} else {
-				err = database.AddMessageToConversation(server.DB, userSender.Id, userReceiver.Id, msgJSON.Text, time.Unix(msgJSON.Timestamp, 0))
-				if err != nil {
-					server.logger.Println(err)
-				} else {
-					if userSender.Online {
-						err = sendMessage(server.Conns[userSender.Id], msgJSON)
-						if err != nil {
-							server.logger.Println("kafka " + userSender.Login + " " + err.Error())
-						}
-					}
-					if userReceiver.Online {
-						err = sendMessage(server.Conns[userReceiver.Id], msgJSON)
-						if err != nil {
-							server.logger.Println("kafka " + userReceiver.Login + " " + err.Error())
-						}
-					}
-					server.logger.Println(userSender.Login + " sent to " + userReceiver.Login + " msg")
-				}
-			}
+// frameUser находит участника кадра kafka по id, а для кадров без id - по логину;
+// удаленный аккаунт считается ненайденным
+func (server *Server) frameUser(ctx context.Context, id int, login string) (*handlers.User, error) {
+	var user *handlers.User
+	err := traceDB(ctx, "get_frame_user", func() (err error) {
+		if id == 0 {
+			user, err = database.GetUserByLogin(server.DB, login)
 		} else {
-			server.logger.Println("user " + msgJSON.Receiver + " not found")
-			errorMsg := handlers.Msg{
-				Sender:   msgJSON.Sender,
-				Receiver: msgJSON.Receiver,
-				Status:   1,
-				Text:     "incorrect user",
+			user, err = database.GetUserById(server.DB, id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if database.IsDeletedLogin(user.Login) {
+		return nil, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+// processChatMsg сохраняет сообщение чата и рассылает его участникам
+func (server *Server) processChatMsg(ctx context.Context, msgJSON handlers.Msg) {
+	userReceiver, err := server.frameUser(ctx, msgJSON.ReceiverID, msgJSON.Receiver)
+
+	if err == nil {
+		userSender, err := server.frameUser(ctx, msgJSON.SenderID, msgJSON.Sender)
+		if err != nil {
+			if msgJSON.Attachment != nil {
+				server.deleteBlob(msgJSON.Attachment.Key)
 			}
-			userSender, err := database.GetUserByLogin(server.DB, msgJSON.Sender)
-			if err != nil {
-				server.logger.Println("user " + msgJSON.Receiver + " not found")
-			} else {
-				if userSender.Online {
-					err = sendMessage(server.Conns[userSender.Id], errorMsg)
-					if err != nil {
-						server.logger.Println("kafka " + userSender.Login + " " + err.Error())
-					}
-				}
+			server.logger.Warn("sender not found", "user", msgJSON.Sender, "user_id", msgJSON.SenderID)
+			return
+		}
+		// логины могли смениться, пока кадр был в kafka; клиентам уходят текущие
+		msgJSON.Sender = userSender.Login
+		msgJSON.Receiver = userReceiver.Login
+		msgJSON.SenderID = 0
+		msgJSON.ReceiverID = 0
+		err = traceDB(ctx, "can_message", func() error {
+			return database.CanMessage(server.DB, userSender.Id, userReceiver.Id)
+		})
+		if err != nil {
+			if msgJSON.Attachment != nil {
+				server.deleteBlob(msgJSON.Attachment.Key)
 			}
+			server.logger.Info("message not allowed", "user", userSender.Login, "receiver", userReceiver.Login, "error", err)
+			server.deliver(userSender, errorMsg(msgJSON, err))
+			return
+		}
+		verdict := server.moderate(msgJSON)
+		if verdict.Action == moderation.Reject {
+			if msgJSON.Attachment != nil {
+				server.deleteBlob(msgJSON.Attachment.Key)
+			}
+			server.deliver(userSender, errorMsg(msgJSON, errRejected))
+			return
+		}
+		msgJSON.Text = verdict.Text
+		var dbMsg *handlers.DataBaseMsg
+		err = traceDB(ctx, "add_message_to_conversation", func() (err error) {
+			dbMsg, err = database.AddMessageToConversation(server.DB, userSender.Id, userReceiver.Id, msgJSON.Text, time.UnixMilli(msgJSON.Timestamp), msgJSON.ReplyTo, msgJSON.Attachment)
+			return err
+		})
+		if err != nil && msgJSON.Attachment != nil {
+			// сообщение не сохранилось, и на загруженный файл больше никто не сошлется
+			server.deleteBlob(msgJSON.Attachment.Key)
+		}
+		if errors.Is(err, database.ErrReplyOutside) {
+			server.deliver(userSender, errorMsg(msgJSON, err))
+			return
+		}
+		if err != nil {
+			server.logger.Error("add message", "user", userSender.Login, "receiver", userReceiver.Login, "error", err)
+			return
+		}
+		server.metrics.MessagesPersisted.Inc()
+		if verdict.Flagged {
+			server.flag(dbMsg.ID, verdict)
+		}
+		msgJSON.ID = dbMsg.ID
+		msgJSON.Seq = dbMsg.Seq
+		msgJSON.Timestamp = dbMsg.SentAt.UnixMilli()
+		msgJSON.Quote = dbMsg.ReplyQuote
+		msgJSON.ThreadID = dbMsg.ThreadRootId
+		msgJSON.Attachment = publicAttachment(dbMsg.Attachment)
+		_, span := tracer.Start(ctx, "deliver")
+		server.deliver(userSender, msgJSON)
+		server.deliver(userReceiver, msgJSON)
+		span.End()
+		server.logger.Info("message delivered", "user", userSender.Login, "receiver", userReceiver.Login,
+			"conversation_id", dbMsg.ConversationId, "message_id", dbMsg.ID)
+	} else {
+		if msgJSON.Attachment != nil {
+			server.deleteBlob(msgJSON.Attachment.Key)
+		}
+		server.logger.Warn("receiver not found", "user", msgJSON.Sender, "receiver", msgJSON.Receiver)
+		errorMsg := handlers.Msg{
+			Sender:   msgJSON.Sender,
+			Receiver: msgJSON.Receiver,
+			Status:   1,
+			Text:     "incorrect user",
+		}
+		userSender, err := server.frameUser(ctx, msgJSON.SenderID, msgJSON.Sender)
+		if err != nil {
+			server.logger.Warn("sender not found", "user", msgJSON.Sender, "user_id", msgJSON.SenderID)
+		} else {
+			server.deliver(userSender, errorMsg)
 		}
-		server.mutex.Unlock()
 	}
 }
 
-func (server *Server) start() {
+// history собирает все сообщения пользователя для отправки при входе; вызывать под server.mutex
+func (server *Server) history(user *handlers.User, logger *slog.Logger) ([]handlers.Msg, error) {
+	msgs, err := database.GetAllUserMessages(server.DB, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]handlers.Msg, 0, len(msgs))
+	for _, imsg := range msgs {
+		user1, user2, err := database.GetUsersByConversaionId(server.DB, imsg.ConversationId)
+		if err != nil {
+			logger.Error("get old msgs", "conversation_id", imsg.ConversationId, "error", err)
+			continue
+		}
+		history = append(history, msgFromDB(imsg, user1, user2))
+	}
+	return history, nil
+}
 
-	server.logger.Println("Server start")
-	go server.ConsumerWorkMsgsTopic()
+// msgFromDB собирает сообщение протокола из строки messages переписки user1 и user2
+func msgFromDB(dbMsg handlers.DataBaseMsg, user1 *handlers.User, user2 *handlers.User) handlers.Msg {
+	msg := handlers.Msg{
+		Timestamp:  dbMsg.SentAt.UnixMilli(),
+		Text:       dbMsg.Body,
+		Status:     0,
+		ID:         dbMsg.ID,
+		Seq:        dbMsg.Seq,
+		Edited:     dbMsg.EditedAt != nil,
+		Deleted:    dbMsg.DeletedAt != nil,
+		ReplyTo:    dbMsg.ReplyTo,
+		Quote:      dbMsg.ReplyQuote,
+		ThreadID:   dbMsg.ThreadRootId,
+		Reactions:  dbMsg.Reactions,
+		Attachment: publicAttachment(dbMsg.Attachment),
+	}
+	if user1.Id == dbMsg.SenderId {
+		msg.Sender = user1.Login
+		msg.Receiver = user2.Login
+	} else {
+		msg.Sender = user2.Login
+		msg.Receiver = user1.Login
+	}
+	if msg.Deleted {
+		msg.Text = ""
+	}
+	return msg
+}
 
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+// deliver отправляет сообщение пользователю, если он подключен; при политике spill событие
+// для только что закрытого соединения уходит в офлайн очередь; вызывать под server.mutex
+func (server *Server) deliver(user *handlers.User, data interface{}) {
+	connection, ok := server.Conns[user.Id]
+	if !ok {
+		return
+	}
+	err := connection.Send(data)
+	if err != nil && !server.deliverOffline(connection, user, data, err) {
+		server.logger.Warn("deliver", "user", user.Login, "conn_id", connection.id, "error", err)
+	}
+}
 
+func (server *Server) start() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server.logger.Info("Server start")
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	consumerDone := make(chan struct{})
 	go func() {
-		for {
-			conn, err := server.tcpServer.listener.Accept()
-			if err != nil {
-				server.logger.Println(err.Error())
-				continue
-			}
-			go server.handleConnection(conn)
+		defer close(consumerDone)
+		server.ConsumerWorkMsgsTopic(consumerCtx)
+	}()
+
+	go server.kafkaDeliveryReports()
+	go server.healthChecks(consumerCtx)
+	go server.limits.Cleanup(consumerCtx.Done())
+	go server.authGuard.Cleanup(consumerCtx.Done())
+	server.startHTTP()
+	go server.tcpServer.Serve(server.handleConnection)
+
+	<-ctx.Done()
+	server.logger.Info("Shutting down server...")
+	server.shutdown(stopConsumer, consumerDone)
+}
+
+// shutdown останавливает сервер: новые соединения и сообщения не принимаются,
+// накопленное в kafka досылается и обрабатывается, и только после этого клиенты
+// получают going_away, сессии снимаются и база закрывается
+func (server *Server) shutdown(stopConsumer context.CancelFunc, consumerDone <-chan struct{}) {
+	server.tcpServer.StopAccepting()
+
+	server.produceMutex.Lock()
+	server.stopping = true
+	server.produceMutex.Unlock()
+
+	if remaining := server.kafkaProducer.Flush(int(server.config.KafkaFlushTimeout.Milliseconds())); remaining > 0 {
+		server.logger.Warn("kafka flush: messages were not delivered", "remaining", remaining)
+	}
+	stopConsumer()
+	<-consumerDone
+
+	server.mutex.Lock()
+	goingAway := goingAwayMsg("server is shutting down")
+	for _, connection := range server.Conns {
+		if err := connection.Send(goingAway); err != nil {
+			server.logger.Warn("going away", "conn_id", connection.id, "error", err)
 		}
+	}
+	// CloseAfterFlush может ждать до WriteTimeout, медленные клиенты не должны задерживать остальных
+	for _, connection := range server.connections {
+		go connection.CloseAfterFlush()
+	}
+	err := database.SetAllUsersOffline(server.DB)
+	if err != nil {
+		server.logger.Error("reset online users", "error", err)
+	}
+	server.mutex.Unlock()
 
-	}()
+	if !server.tcpServer.WaitConnections(server.config.ShutdownTimeout) {
+		server.logger.Warn("shutdown timeout: closing remaining connections")
+		server.mutex.Lock()
+		for _, connection := range server.connections {
+			connection.Close()
+		}
+		server.mutex.Unlock()
+	}
 
-	<-sigchan
-	server.logger.Println("Shutting down server...")
 	server.Close()
 }
 
 func (server *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	ip := remoteIP(conn)
+	if !server.limits.AcquireConnection(ip) {
+		server.logger.Warn("too many connections", "remote", ip)
+		server.metrics.Throttled.WithLabelValues("connection").Inc()
+		sendMessage(conn, handlers.AuthMsg{Status: handlers.AuthThrottled})
+		conn.Close()
+		return
+	}
+	defer server.limits.ReleaseConnection(ip)
+
+	connection := NewConnection(conn, server.lastConnId.Add(1), server.config, &server.queueStats)
+	server.mutex.Lock()
+	server.connections[connection.id] = connection
+	server.snapshotConnections()
+	server.mutex.Unlock()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.connections, connection.id)
+		server.snapshotConnections()
+		server.mutex.Unlock()
+		connection.Close()
+	}()
 
+	connLogger := server.logger.With("conn_id", connection.id, "remote", conn.RemoteAddr().String())
+	logger := connLogger
 	reader := bufio.NewReader(conn)
 	var msg handlers.AuthMsg
 
-	data, err := reader.ReadString('\n')
+	connection.SetIdleDeadline(server.config.IdleTimeout)
+	data, err := readFrame(reader, server.config.MaxFrameSize)
+	if errors.Is(err, ErrFrameTooLarge) {
+		logger.Warn("auth frame too large", "limit", server.config.MaxFrameSize)
+		return
+	}
 	if err != nil {
-		server.logger.Println(err.Error())
+		logger.Info("read auth", "error", err)
 		return
 	}
-	err = json.Unmarshal([]byte(data), &msg)
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		logger.Warn("bad auth message", "error", err)
+		return
+	}
+	if err = validation.ValidUTF8(data); err == nil {
+		msg.Login, err = validation.NormalizeLogin(msg.Login)
+	}
 	if err != nil {
-		server.logger.Println(err.Error())
+		logger.Info("invalid auth message", "error", err)
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Status: handlers.AuthInvalid, Code: validationCode(err)})
+		return
+	}
+
+	if !server.limits.AllowAuth(ip) {
+		logger.Warn("too many auth attempts", "user", msg.Login)
+		server.metrics.Throttled.WithLabelValues("auth").Inc()
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Status: handlers.AuthThrottled})
+		return
+	}
+
+	if locked, until := server.authGuard.Locked(msg.Login, ip); locked {
+		logger.Warn("login locked", "user", msg.Login, "until", until)
+		server.metrics.Logins.WithLabelValues("locked").Inc()
+		server.auditAuth(msg.Login, ip, database.AuthEventRejected)
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Timestamp: until.Unix(), Status: handlers.AuthLocked})
+		return
+	}
+
+	if !server.health.DatabaseOK() {
+		logger.Warn("database unavailable, login refused", "user", msg.Login)
+		server.metrics.Logins.WithLabelValues("unavailable").Inc()
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Status: handlers.AuthUnavailable})
 		return
 	}
 
@@ -222,10 +560,36 @@ func (server *Server) handleConnection(conn net.Conn) {
 	user, err := database.GetUserByLogin(server.DB, msg.Login)
 	server.mutex.Unlock()
 
-	if (err == sql.ErrNoRows && msg.Status == 1) || (err == nil && user.HashPassword != utility.ToHex(msg.HashPassword)) || (err == nil && msg.Status == 0) || (err == nil && user.Online) {
-		server.logger.Println("user " + msg.Login + " not found or invalid password")
-		output := handlers.AuthMsg{Login: msg.Login, HashPassword: msg.HashPassword, Status: 2}
-		err = sendMessage(conn, output)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("get user", "user", msg.Login, "error", err)
+		server.metrics.Logins.WithLabelValues("unavailable").Inc()
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Status: handlers.AuthUnavailable})
+		return
+	}
+
+	badCredentials := msg.Status == 1 && (err == sql.ErrNoRows || user.HashPassword != utility.ToHex(msg.HashPassword))
+	if badCredentials || (err == nil && user.HashPassword != utility.ToHex(msg.HashPassword)) || (err == nil && msg.Status == 0) || (err == nil && user.Online) {
+		logger.Info("user not found or invalid password", "user", msg.Login)
+		server.metrics.Logins.WithLabelValues("failed").Inc()
+		if badCredentials {
+			delay, locked := server.authGuard.Failure(msg.Login, ip)
+			server.auditAuth(msg.Login, ip, database.AuthEventLoginFailed)
+			if locked {
+				logger.Warn("too many failed logins, locked", "user", msg.Login)
+				server.auditAuth(msg.Login, ip, database.AuthEventLocked)
+			}
+			time.Sleep(delay)
+		}
+		output := handlers.AuthMsg{Login: msg.Login, HashPassword: msg.HashPassword, Status: handlers.AuthFailed}
+		sendMessage(conn, output)
+		return
+	}
+
+	if err == nil && user.BannedUntil.After(time.Now()) {
+		logger.Info("banned user login refused", "user", msg.Login, "until", user.BannedUntil)
+		server.metrics.Logins.WithLabelValues("banned").Inc()
+		server.auditAuth(msg.Login, ip, database.AuthEventBanned)
+		sendMessage(conn, handlers.AuthMsg{Login: msg.Login, Timestamp: user.BannedUntil.Unix(), Status: handlers.AuthBanned})
 		return
 	}
 
@@ -241,135 +605,547 @@ func (server *Server) handleConnection(conn net.Conn) {
 		fl = false
 		err = database.CreateUser(server.DB, user)
 		if err != nil {
-			server.logger.Println(err)
+			logger.Error("create user", "user", msg.Login, "error", err)
 		}
 
 		user, err = database.GetUserByLogin(server.DB, user.Login)
 		if err != nil {
-			server.logger.Println(err)
+			logger.Error("get user", "user", msg.Login, "error", err)
 			server.mutex.Unlock()
 			return
 		}
 	}
 
-	server.Conns[user.Id] = conn
+	logger = connLogger.With("user", user.Login)
+	server.Conns[user.Id] = connection
+	server.metrics.ConnectedClients.Inc()
+	connection.userId = user.Id
+	defer server.unregister(connection, user)
 	err = database.UpdateUserOnline(server.DB, user.Id, true)
 	if err != nil {
-		server.logger.Println(err)
+		logger.Error("update online", "error", err)
 		server.mutex.Unlock()
 		return
 	}
 
-	server.logger.Println("User " + msg.Login + " online at " + time.Now().Format("2006-01-02 15:04:05"))
+	logger.Info("User online", "registered", !fl)
+	if fl {
+		server.metrics.Logins.WithLabelValues("success").Inc()
+	} else {
+		server.metrics.Logins.WithLabelValues("registered").Inc()
+	}
 
 	server.mutex.Unlock()
 
-	err = sendMessage(conn, handlers.AuthMsg{Login: msg.Login, HashPassword: msg.HashPassword, Status: 0})
+	server.authGuard.Success(user.Login, ip)
+	if fl {
+		server.auditAuth(user.Login, ip, database.AuthEventLoginSuccess)
+	} else {
+		server.auditAuth(user.Login, ip, database.AuthEventRegister)
+	}
+
+	err = connection.SendWait(handlers.AuthMsg{Login: msg.Login, HashPassword: msg.HashPassword, Status: handlers.AuthOk})
 	if err != nil {
-		server.logger.Println(err.Error())
+		logger.Warn("send auth response", "error", err)
 		return
 	}
 
-	// если пользователь уже сущестовал, отправляем ему все предыдущие сообщения
+	// если пользователь уже сущестовал, отправляем ему все предыдущие сообщения;
+	// история собирается под мьютексом, а отправляется без него, чтобы медленный
+	// клиент не задерживал обработку сообщений остальных пользователей
 	if fl {
 		server.mutex.Lock()
-
-		msgs, err := database.GetAllUserMessages(server.DB, user.Id)
+		history, err := server.history(user, logger)
+		server.mutex.Unlock()
 		if err != nil {
-			server.logger.Println(err.Error())
-			server.mutex.Unlock()
+			logger.Error("get old msgs", "error", err)
 			return
 		}
-		for _, imsg := range msgs {
-			user1, user2, err := database.GetUsersByConversaionId(server.DB, imsg.ConversationId)
-			if err != nil {
-				server.logger.Println("get old msgs: " + err.Error())
-			}
-			outMsg := handlers.Msg{
-				Timestamp: imsg.SentAt.Unix(),
-				Text:      imsg.Body,
-				Status:    0,
-			}
-			if user1.Id == imsg.SenderId {
-				outMsg.Sender = user1.Login
-				outMsg.Receiver = user2.Login
-			} else {
-				outMsg.Sender = user2.Login
-				outMsg.Receiver = user1.Login
-			}
-
-			err = sendMessage(conn, outMsg)
+		for _, msg := range history {
+			err = connection.SendWait(msg)
 			if err != nil {
-				server.logger.Println("get old msgs: " + err.Error())
+				logger.Warn("send old msgs", "error", err)
+				return
 			}
 		}
-		server.mutex.Unlock()
+		err = server.replayOffline(connection, user, logger)
+		if err != nil {
+			logger.Warn("send offline frames", "error", err)
+			return
+		}
+	}
+
+	if server.config.HeartbeatInterval > 0 {
+		go connection.Heartbeat(server.config.HeartbeatInterval)
 	}
 
+	transfers := server.newTransfers(connection, user, logger)
+	defer transfers.Close()
+
 	for {
-		line, err := reader.ReadString('\n')
+		connection.SetIdleDeadline(server.config.IdleTimeout)
+		line, err := readFrame(reader, server.config.MaxFrameSize)
 		if err != nil {
-			server.logger.Println(err.Error())
+			var netErr net.Error
+			if errors.Is(err, ErrFrameTooLarge) {
+				logger.Warn("frame too large, closing connection", "limit", server.config.MaxFrameSize)
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				logger.Info("idle timeout, closing connection")
+			} else {
+				logger.Info("read", "error", err)
+			}
 			return
 		}
 
 		var msg handlers.Msg
-		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			server.logger.Println("SS00 " + err.Error())
+		if err := json.Unmarshal(line, &msg); err != nil {
+			logger.Warn("bad message", "error", err)
+			continue
+		}
+		if err := validation.ValidUTF8(line); err != nil {
+			connection.Send(errorMsg(msg, err))
+			continue
+		}
+		if msg.Type == handlers.TypePing {
+			connection.Send(handlers.Msg{Type: handlers.TypePong, Timestamp: time.Now().UnixMilli()})
+			continue
+		}
+		if msg.Type == handlers.TypePong {
 			continue
 		}
 		if msg.Status == 1 {
-			server.mutex.Lock()
-			delete(server.Conns, user.Id)
-			err = database.UpdateUserOnline(server.DB, user.Id, false)
-			if err != nil {
-				server.logger.Println(err.Error())
-			} else {
-				server.logger.Println("User " + user.Login + " disconnected")
-			}
-			server.mutex.Unlock()
 			break
 		}
+		// кадр всегда принадлежит пользователю этого соединения; в базе логины
+		// сравниваются без учета регистра, поэтому и здесь EqualFold
+		if msg.Sender != "" && !strings.EqualFold(msg.Sender, user.Login) {
+			logger.Warn("sender spoofing attempt", "claimed_sender", msg.Sender)
+			connection.Send(errorMsg(msg, validation.ErrSenderMismatch))
+			continue
+		}
+		msg.Sender = user.Login
+		msg.SenderID = user.Id
+		msg.Timestamp = time.Now().UnixMilli()
+		if msg.Type == handlers.TypeTyping {
+			server.typing(user, msg)
+			continue
+		}
+		// куски файла ограничены размером загрузки, а не частотой
+		if msg.Type != handlers.TypeUploadChunk && !server.limits.AllowMessage(user.Login) {
+			server.metrics.Throttled.WithLabelValues("message").Inc()
+			connection.Send(handlers.Msg{
+				Type:      handlers.TypeThrottled,
+				Sender:    msg.Sender,
+				Receiver:  msg.Receiver,
+				Timestamp: time.Now().UnixMilli(),
+				Text:      "rate limit exceeded, message was not sent",
+				Status:    1,
+			})
+			continue
+		}
+		if isTransfer(msg.Type) {
+			transfers.Handle(context.Background(), msg)
+			continue
+		}
+		if err := server.validateMsg(&msg); err != nil {
+			logger.Info("invalid message", "error", err)
+			connection.Send(errorMsg(msg, err))
+			continue
+		}
+		// поиск и список переписок касаются только этого пользователя, поэтому отвечаем сразу, минуя kafka
+		switch msg.Type {
+		case handlers.TypeSearch:
+			server.search(connection, user, msg)
+			continue
+		case handlers.TypeConversations:
+			server.conversations(connection, user)
+			continue
+		case handlers.TypeRead:
+			server.markRead(connection, user, msg)
+			continue
+		case handlers.TypeContacts, handlers.TypeContactAdd, handlers.TypeContactRemove,
+			handlers.TypeBlock, handlers.TypeUnblock, handlers.TypePrivacy:
+			server.contacts(connection, user, msg)
+			continue
+		case handlers.TypeProfile, handlers.TypeProfileUpdate:
+			server.profile(connection, user, msg)
+			continue
+		case handlers.TypeAdmin:
+			server.admin(connection, user, msg)
+			continue
+		case handlers.TypeReport:
+			server.report(connection, user, msg)
+			continue
+		case handlers.TypePasswordChange, handlers.TypeRename, handlers.TypeAccountDelete:
+			if server.account(connection, user, ip, msg) {
+				return
+			}
+			// после смены логина записи соединения идут под новым
+			logger = connLogger.With("user", user.Login)
+			transfers.logger = logger
+			continue
+		}
 
-		err = server.sendToKafkaMsgsTopic(msg)
+		msgCtx, span := tracer.Start(context.Background(), "tcp.receive",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("user", user.Login), attribute.Int64("conn_id", connection.id)))
+		err = server.sendToKafkaMsgsTopic(msgCtx, msg)
 		if err != nil {
-			server.logger.Println(err.Error())
+			logger.Error("send to kafka", "error", err)
+			span.RecordError(err)
+			connection.Send(errorMsg(msg, err))
 		}
+		span.End()
 	}
 
 }
 
+// validateMsg проверяет поля сообщения в зависимости от его типа и нормализует текст
+func (server *Server) validateMsg(msg *handlers.Msg) error {
+	switch msg.Type {
+	case handlers.TypeChat:
+		receiver, err := validation.NormalizeLogin(msg.Receiver)
+		if err != nil {
+			return err
+		}
+		msg.Receiver = receiver
+		// цитату, ветку и вложение сервер заполняет сам
+		msg.Quote = ""
+		msg.ThreadID = 0
+		msg.Attachment = nil
+	case handlers.TypeEdit:
+		if msg.ID <= 0 {
+			return validation.ErrNoMsgID
+		}
+	case handlers.TypeDelete:
+		if msg.ID <= 0 {
+			return validation.ErrNoMsgID
+		}
+		if msg.Scope == "" {
+			msg.Scope = handlers.DeleteForMe
+		}
+		if msg.Scope != handlers.DeleteForMe && msg.Scope != handlers.DeleteForEveryone {
+			return validation.ErrBadScope
+		}
+		return nil
+	case handlers.TypeReact, handlers.TypeUnreact:
+		if msg.ID <= 0 {
+			return validation.ErrNoMsgID
+		}
+		emoji, err := validation.NormalizeEmoji(msg.Emoji)
+		if err != nil {
+			return err
+		}
+		msg.Emoji = emoji
+		msg.Reactions = nil
+		return nil
+	case handlers.TypeConversations, handlers.TypeContacts:
+		return nil
+	case handlers.TypeContactAdd, handlers.TypeContactRemove, handlers.TypeBlock, handlers.TypeUnblock:
+		receiver, err := validation.NormalizeLogin(msg.Receiver)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(receiver, msg.Sender) {
+			return validation.ErrSelfTarget
+		}
+		msg.Receiver = receiver
+		return nil
+	case handlers.TypeProfile:
+		if msg.Receiver != "" {
+			receiver, err := validation.NormalizeLogin(msg.Receiver)
+			if err != nil {
+				return err
+			}
+			msg.Receiver = receiver
+		}
+		return nil
+	case handlers.TypeProfileUpdate:
+		if msg.Profile == nil {
+			return validation.ErrNoProfile
+		}
+		var err error
+		msg.Profile.DisplayName, err = validation.NormalizeProfileText(msg.Profile.DisplayName,
+			validation.MaxDisplayNameLength, validation.ErrDisplayNameTooLong)
+		if err != nil {
+			return err
+		}
+		msg.Profile.Bio, err = validation.NormalizeProfileText(msg.Profile.Bio, validation.MaxBioLength, validation.ErrBioTooLong)
+		if err != nil {
+			return err
+		}
+		return validation.ValidTimezone(msg.Profile.Timezone)
+	case handlers.TypePasswordChange, handlers.TypeRename, handlers.TypeAccountDelete:
+		if msg.Account == nil {
+			return validation.ErrNoAccount
+		}
+		switch msg.Type {
+		case handlers.TypePasswordChange:
+			if msg.Account.NewPassword == [32]byte{} {
+				return validation.ErrNoPassword
+			}
+		case handlers.TypeRename:
+			login, err := validation.NormalizeLogin(msg.Account.NewLogin)
+			if err != nil {
+				return err
+			}
+			msg.Account.NewLogin = login
+		}
+		return nil
+	case handlers.TypeAdmin:
+		return server.validateAdmin(msg)
+	case handlers.TypeReport:
+		if msg.ID <= 0 {
+			return validation.ErrNoMsgID
+		}
+		if msg.Text != "" {
+			var err error
+			msg.Text, err = validation.NormalizeText(msg.Text, validation.MaxReasonLength)
+			return err
+		}
+		return nil
+	case handlers.TypePrivacy:
+		if msg.Privacy != nil && !(validPrivacy(msg.Privacy.Messages) && validPrivacy(msg.Privacy.Online)) {
+			return validation.ErrBadPrivacy
+		}
+		return nil
+	case handlers.TypeRead:
+		receiver, err := validation.NormalizeLogin(msg.Receiver)
+		if err != nil {
+			return err
+		}
+		msg.Receiver = receiver
+		if msg.Seq <= 0 {
+			return validation.ErrNoMsgID
+		}
+		return nil
+	case handlers.TypeSearch:
+		if msg.Receiver != "" {
+			receiver, err := validation.NormalizeLogin(msg.Receiver)
+			if err != nil {
+				return err
+			}
+			msg.Receiver = receiver
+		}
+		if msg.Since < 0 || msg.Until < 0 || (msg.Until != 0 && msg.Until <= msg.Since) {
+			return validation.ErrBadSearchRange
+		}
+		text, err := validation.NormalizeText(msg.Text, validation.MaxSearchLength)
+		if err != nil {
+			return err
+		}
+		msg.Text = text
+		return nil
+	default:
+		return validation.ErrUnknownType
+	}
+
+	text, err := validation.NormalizeText(msg.Text, server.config.MaxMessageLength)
+	if err != nil {
+		return err
+	}
+	msg.Text = text
+	return nil
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// коды ошибок базы, о которых сообщается клиенту
+var errorCodes = map[error]string{
+	database.ErrMsgNotFound:    "msg_not_found",
+	database.ErrNotAuthor:      "not_author",
+	database.ErrNotParticipant: "not_participant",
+	database.ErrMsgDeleted:     "msg_deleted",
+	database.ErrReplyOutside:   "reply_outside_conversation",
+	database.ErrTooManyReacts:  "too_many_reactions",
+	database.ErrNoAttachment:   "attachment_not_found",
+	database.ErrEmptySearch:    "empty_search",
+	database.ErrNotAllowed:     "not_allowed",
+	database.ErrWrongPassword:  "wrong_password",
+	database.ErrLoginTaken:     "login_taken",
+	errForbidden:               "forbidden",
+	errNotLocked:               "not_locked",
+	errRejected:                "content_rejected",
+	database.ErrOwnMsg:         "own_message",
+	database.ErrReported:       "already_reported",
+	database.ErrNoReport:       "report_not_found",
+	blobstore.ErrNotFound:      "attachment_not_found",
+	errShuttingDown:            "shutting_down",
+}
+
+func validationCode(err error) string {
+	var validationErr *validation.Error
+	if errors.As(err, &validationErr) {
+		return validationErr.Code
+	}
+	for target, code := range errorCodes {
+		if errors.Is(err, target) {
+			return code
+		}
+	}
+	return "invalid"
+}
+
+// errorMsg - ответ клиенту об ошибке в его сообщении msg
+func errorMsg(msg handlers.Msg, err error) handlers.Msg {
+	return handlers.Msg{
+		Type:      handlers.TypeError,
+		Sender:    msg.Sender,
+		Receiver:  msg.Receiver,
+		Timestamp: time.Now().UnixMilli(),
+		Text:      err.Error(),
+		Status:    1,
+		Code:      validationCode(err),
+	}
+}
+
+// auditAuth записывает событие входа в таблицу auth_events
+func (server *Server) auditAuth(login string, ip string, event string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	err := database.AddAuthEvent(server.DB, login, ip, event)
+	if err != nil {
+		server.logger.Error("audit auth event", "user", login, "event", event, "error", err)
+	}
+}
+
+// snapshotConnections публикует текущий список соединений для метрик; вызывать под server.mutex
+func (server *Server) snapshotConnections() {
+	snapshot := make([]*Connection, 0, len(server.connections))
+	for _, connection := range server.connections {
+		snapshot = append(snapshot, connection)
+	}
+	server.connectionsSnapshot.Store(&snapshot)
+}
+
+// unregister убирает соединение пользователя и снимает флаг online,
+// если за это время пользователь не переподключился с другого соединения;
+// у удаленного аккаунта ни флага, ни офлайн очереди уже нет
+func (server *Server) unregister(connection *Connection, user *handlers.User) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	logger := server.logger.With("conn_id", connection.id, "user", user.Login)
+	if !connection.accountDeleted {
+		server.saveUnsent(connection, user.Id, logger)
+	}
+	if server.Conns[user.Id] != connection {
+		return
+	}
+	delete(server.Conns, user.Id)
+	server.metrics.ConnectedClients.Dec()
+	if connection.accountDeleted {
+		logger.Info("User disconnected", "account_deleted", true)
+		return
+	}
+	if dropped := connection.Dropped(); dropped > 0 {
+		logger.Warn("slow consumer", "dropped", dropped, "policy", server.config.OverflowPolicy.String())
+	}
+	err := database.UpdateUserOnline(server.DB, user.Id, false)
+	if err != nil {
+		logger.Error("update online", "error", err)
+	} else {
+		logger.Info("User disconnected")
+	}
+}
+
 func (server *Server) Close() {
-	server.logger.Println("Closing server...")
+	server.logger.Info("Closing server...")
+	server.logger.Info("send queues",
+		"dropped", server.queueStats.Dropped.Load(),
+		"spilled", server.queueStats.Spilled.Load(),
+		"disconnected", server.queueStats.Disconnected.Load(),
+		"persisted", server.queueStats.Persisted.Load())
 	server.tcpServer.Close()
+	if server.httpServer != nil {
+		server.httpServer.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.config.KafkaFlushTimeout)
+	defer cancel()
+	if err := server.tracingShutdown(ctx); err != nil {
+		server.logger.Warn("tracing shutdown", "error", err)
+	}
 	server.loggerFile.Close()
 	server.kafkaProducer.Close()
 	server.DB.Close()
 }
 
-func (server *Server) sendToKafkaMsgsTopic(msg interface{}) error {
+// sendToKafkaMsgsTopic кладет кадр в kafka; получатель определяется по логину здесь,
+// дальше кадр ссылается на него по id
+func (server *Server) sendToKafkaMsgsTopic(ctx context.Context, msg handlers.Msg) error {
+	ctx, span := tracer.Start(ctx, "kafka.produce", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", server.kafkaMsgTopic)))
+	defer span.End()
+
+	msg.ReceiverID = 0
+	if msg.Receiver != "" {
+		server.mutex.Lock()
+		receiver, err := database.GetUserByLogin(server.DB, msg.Receiver)
+		server.mutex.Unlock()
+		// неизвестного получателя consumer не найдет и ответит отправителю ошибкой
+		if err == nil {
+			msg.ReceiverID = receiver.Id
+		}
+	}
+
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
-		server.logger.Println(err.Error())
 		return err
 	}
 
-	return server.kafkaProducer.Produce(&kafka.Message{
+	kafkaMsg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &server.kafkaMsgTopic,
 			Partition: kafka.PartitionAny,
 		},
-		Value: jsonMsg,
-	}, nil)
+		Value:  jsonMsg,
+		Opaque: time.Now(),
+	}
+	injectKafkaHeaders(ctx, kafkaMsg)
+	server.produceMutex.RLock()
+	defer server.produceMutex.RUnlock()
+	if server.stopping {
+		return errShuttingDown
+	}
+	err = server.kafkaProducer.Produce(kafkaMsg, nil)
+	if err != nil {
+		server.metrics.KafkaProduceErrors.Inc()
+		span.RecordError(err)
+	}
+	return err
+}
+
+// kafkaDeliveryReports читает отчеты о доставке продюсера, пока он не будет закрыт
+func (server *Server) kafkaDeliveryReports() {
+	for event := range server.kafkaProducer.Events() {
+		msg, ok := event.(*kafka.Message)
+		if !ok {
+			continue
+		}
+		if msg.TopicPartition.Error != nil {
+			server.metrics.KafkaProduceErrors.Inc()
+			server.logger.Error("kafka delivery", "topic", server.kafkaMsgTopic, "error", msg.TopicPartition.Error)
+			continue
+		}
+		server.metrics.MessagesProduced.Inc()
+		if producedAt, ok := msg.Opaque.(time.Time); ok {
+			server.metrics.KafkaProduceLatency.Observe(time.Since(producedAt).Seconds())
+		}
+	}
 }
 
 func main() {
+	config, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
 
-	server, err := NewServer("localhost", 14232, ":9092", "msgTopic", "root:"+SecurityMySQLRootPassword+"@tcp(localhost:3306)/f.db?parseTime=true")
+	server, err := NewServer("localhost", 14232, ":9092", "msgTopic", "root:"+SecurityMySQLRootPassword+"@tcp(localhost:3306)/f.db?parseTime=true", config)
 	if err != nil {
-		server.logger.Fatal(err)
-		panic(err)
+		log.Fatal(err)
 	}
 	server.start()
-	server.Close()
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("gochat/server")
+
+// InitTracing настраивает экспорт трейсов; для exporter "" или "none" спаны не экспортируются
+func InitTracing(config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.TraceExporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+		if config.OTLPInsecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.TraceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("gochat-server"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// kafkaHeaderCarrier позволяет передавать контекст трейса в заголовках сообщений kafka
+type kafkaHeaderCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (carrier kafkaHeaderCarrier) Get(key string) string {
+	for _, header := range *carrier.headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (carrier kafkaHeaderCarrier) Set(key string, value string) {
+	for i, header := range *carrier.headers {
+		if header.Key == key {
+			(*carrier.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*carrier.headers = append(*carrier.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (carrier kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*carrier.headers))
+	for _, header := range *carrier.headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
+
+func injectKafkaHeaders(ctx context.Context, msg *kafka.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, kafkaHeaderCarrier{headers: &msg.Headers})
+}
+
+func extractKafkaHeaders(ctx context.Context, msg *kafka.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, kafkaHeaderCarrier{headers: &msg.Headers})
+}
+
+// traceDB оборачивает запрос к базе в спан
+func traceDB(ctx context.Context, query string, fn func() error) error {
+	_, span := tracer.Start(ctx, "db."+query, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "mysql")))
+	defer span.End()
+	err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
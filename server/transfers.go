@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"server/blobstore"
+	"server/database"
+	"server/handlers"
+	"server/validation"
+)
+
+// upload - незавершенная загрузка файла во временный файл
+type upload struct {
+	msg        handlers.Msg
+	attachment handlers.Attachment
+	file       *os.File
+	hash       hash.Hash
+	received   int64
+}
+
+// transfers - загрузки одного соединения; используется только из горутины, читающей это соединение
+type transfers struct {
+	server     *Server
+	connection *Connection
+	user       *handlers.User
+	logger     *slog.Logger
+	uploads    map[string]*upload
+}
+
+func (server *Server) newTransfers(connection *Connection, user *handlers.User, logger *slog.Logger) *transfers {
+	return &transfers{
+		server:     server,
+		connection: connection,
+		user:       user,
+		logger:     logger,
+		uploads:    make(map[string]*upload),
+	}
+}
+
+func isTransfer(msgType string) bool {
+	switch msgType {
+	case handlers.TypeUploadStart, handlers.TypeUploadChunk, handlers.TypeUploadDone,
+		handlers.TypeUploadAbort, handlers.TypeDownload:
+		return true
+	}
+	return false
+}
+
+// Handle обрабатывает кадр передачи файла; ошибки отправляет клиенту
+func (t *transfers) Handle(ctx context.Context, msg handlers.Msg) {
+	var err error
+	switch msg.Type {
+	case handlers.TypeUploadStart:
+		err = t.start(msg)
+	case handlers.TypeUploadChunk:
+		err = t.chunk(msg)
+	case handlers.TypeUploadDone:
+		err = t.done(ctx, msg)
+	case handlers.TypeUploadAbort:
+		t.abort(msg.Upload)
+	case handlers.TypeDownload:
+		err = t.download(ctx, msg)
+	}
+	if err != nil {
+		t.logger.Info("file transfer", "type", msg.Type, "upload", msg.Upload, "error", err)
+		t.connection.Send(errorMsg(msg, err))
+	}
+}
+
+func (t *transfers) start(msg handlers.Msg) error {
+	if msg.Purpose != handlers.PurposeAttachment && msg.Purpose != handlers.PurposeAvatar {
+		return validation.ErrBadAttachment
+	}
+	if msg.Attachment == nil || msg.Attachment.Size <= 0 || len(msg.Attachment.SHA256) != sha256.Size*2 {
+		return validation.ErrBadAttachment
+	}
+	maxSize := t.server.config.MaxAttachmentSize
+	if msg.Purpose == handlers.PurposeAvatar {
+		maxSize = t.server.config.MaxAvatarSize
+	}
+	if msg.Attachment.Size > maxSize {
+		return validation.ErrAttachmentTooBig
+	}
+	name, err := validation.NormalizeFileName(msg.Attachment.Name)
+	if err != nil {
+		return err
+	}
+	if len(t.uploads) >= t.server.config.MaxUploadsPerConnection {
+		return validation.ErrTooManyUploads
+	}
+
+	// у аватара нет получателя и текста
+	var receiver string
+	if msg.Purpose == handlers.PurposeAttachment {
+		receiver, err = validation.NormalizeLogin(msg.Receiver)
+		if err != nil {
+			return err
+		}
+		if msg.Text != "" {
+			msg.Text, err = validation.NormalizeText(msg.Text, t.server.config.MaxMessageLength)
+			if err != nil {
+				return err
+			}
+		}
+
+		// получатель проверяется сразу, чтобы не принимать файл, который некуда доставить
+		t.server.mutex.Lock()
+		peer, err := database.GetUserByLogin(t.server.DB, receiver)
+		if err == nil {
+			err = database.CanMessage(t.server.DB, t.user.Id, peer.Id)
+		}
+		t.server.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return err
+	}
+	id := blobstore.NewKey()
+	t.uploads[id] = &upload{
+		msg: handlers.Msg{
+			Sender:   t.user.Login,
+			Receiver: receiver,
+			Text:     msg.Text,
+			ReplyTo:  msg.ReplyTo,
+			Purpose:  msg.Purpose,
+		},
+		attachment: handlers.Attachment{
+			Name:   name,
+			Size:   msg.Attachment.Size,
+			SHA256: strings.ToLower(msg.Attachment.SHA256),
+		},
+		file: file,
+		hash: sha256.New(),
+	}
+	t.logger.Info("upload started", "upload", id, "receiver", receiver, "purpose", msg.Purpose, "size", msg.Attachment.Size)
+	return t.connection.Send(handlers.Msg{
+		Type:       handlers.TypeUploadStart,
+		Sender:     t.user.Login,
+		Receiver:   receiver,
+		Purpose:    msg.Purpose,
+		Upload:     id,
+		Attachment: &t.uploads[id].attachment,
+	})
+}
+
+// chunk дописывает кусок в файл; куски должны идти подряд без пропусков
+func (t *transfers) chunk(msg handlers.Msg) error {
+	up, ok := t.uploads[msg.Upload]
+	if !ok {
+		return validation.ErrNoUpload
+	}
+	if msg.Offset != up.received || len(msg.Data) == 0 || len(msg.Data) > t.server.config.MaxChunkSize ||
+		up.received+int64(len(msg.Data)) > up.attachment.Size {
+		t.abort(msg.Upload)
+		return validation.ErrBadChunk
+	}
+	if up.received == 0 {
+		up.attachment.ContentType = http.DetectContentType(msg.Data)
+	}
+	_, err := up.file.Write(msg.Data)
+	if err != nil {
+		t.abort(msg.Upload)
+		return err
+	}
+	up.hash.Write(msg.Data)
+	up.received += int64(len(msg.Data))
+	return nil
+}
+
+// done проверяет файл, кладет его в хранилище и отправляет сообщение с вложением через kafka
+func (t *transfers) done(ctx context.Context, msg handlers.Msg) error {
+	up, ok := t.uploads[msg.Upload]
+	if !ok {
+		return validation.ErrNoUpload
+	}
+	defer t.abort(msg.Upload)
+	if up.received != up.attachment.Size {
+		return validation.ErrIncompleteUpload
+	}
+	if hex.EncodeToString(up.hash.Sum(nil)) != up.attachment.SHA256 {
+		return validation.ErrChecksumMismatch
+	}
+	if up.msg.Purpose == handlers.PurposeAvatar && !strings.HasPrefix(up.attachment.ContentType, "image/") {
+		return validation.ErrNotImage
+	}
+
+	_, err := up.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	up.attachment.Key = blobstore.NewKey()
+	err = t.server.blobs.Put(ctx, up.attachment.Key, up.file, up.attachment.Size)
+	if err != nil {
+		return err
+	}
+
+	if up.msg.Purpose == handlers.PurposeAvatar {
+		return t.setAvatar(msg, up)
+	}
+
+	chatMsg := up.msg
+	chatMsg.Timestamp = msg.Timestamp
+	chatMsg.Attachment = &up.attachment
+	// отправитель - владелец загрузки, а не то, что клиент указал в upload_start
+	chatMsg.SenderID = t.user.Id
+	chatMsg.Sender = t.user.Login
+	err = t.server.sendToKafkaMsgsTopic(ctx, chatMsg)
+	if err != nil {
+		t.server.deleteBlob(up.attachment.Key)
+		return err
+	}
+	t.logger.Info("upload finished", "upload", msg.Upload, "key", up.attachment.Key, "size", up.attachment.Size)
+	return nil
+}
+
+// setAvatar сохраняет загруженный аватар, удаляет прежний и отвечает обновленным профилем
+func (t *transfers) setAvatar(msg handlers.Msg, up *upload) error {
+	t.server.mutex.Lock()
+	oldKey, err := database.SetAvatar(t.server.DB, t.user.Id, up.attachment)
+	var profile *handlers.Profile
+	if err == nil {
+		profile, err = t.server.visibleProfile(t.user, t.user)
+	}
+	t.server.mutex.Unlock()
+	if err != nil {
+		t.server.deleteBlob(up.attachment.Key)
+		return err
+	}
+	if oldKey != "" {
+		t.server.deleteBlob(oldKey)
+	}
+	t.logger.Info("avatar updated", "upload", msg.Upload, "key", up.attachment.Key, "size", up.attachment.Size)
+	return t.connection.Send(handlers.Msg{
+		Type:     handlers.TypeProfile,
+		Receiver: t.user.Login,
+		Profile:  profile,
+	})
+}
+
+func (t *transfers) abort(id string) {
+	up, ok := t.uploads[id]
+	if !ok {
+		return
+	}
+	up.file.Close()
+	os.Remove(up.file.Name())
+	delete(t.uploads, id)
+}
+
+// download отправляет файл кусками; пока он идет, кадры от клиента не читаются,
+// поэтому на одном соединении одновременно идет не больше одного скачивания,
+// а таймаут бездействия откладывается после каждого отправленного куска
+func (t *transfers) download(ctx context.Context, msg handlers.Msg) error {
+	var attachment *handlers.Attachment
+	var err error
+	if msg.Purpose == handlers.PurposeAvatar {
+		attachment, err = t.avatar(msg.Receiver)
+	} else {
+		if msg.ID <= 0 {
+			return validation.ErrNoMsgID
+		}
+		t.server.mutex.Lock()
+		attachment, err = database.GetParticipantAttachment(t.server.DB, msg.ID, t.user.Id)
+		t.server.mutex.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	blob, err := t.server.blobs.Get(ctx, attachment.Key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	public := publicAttachment(attachment)
+	buf := make([]byte, t.server.config.MaxChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(blob, buf)
+		if n > 0 {
+			sendErr := t.connection.SendWait(handlers.Msg{
+				Type:     handlers.TypeDownloadChunk,
+				ID:       attachment.ID,
+				Receiver: msg.Receiver,
+				Purpose:  msg.Purpose,
+				Offset:   offset,
+				Data:     buf[:n],
+			})
+			if sendErr != nil {
+				return sendErr
+			}
+			// клиент занят приемом и молчит не по своей вине
+			t.connection.SetIdleDeadline(t.server.config.IdleTimeout)
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return t.connection.SendWait(handlers.Msg{
+		Type:       handlers.TypeDownloadDone,
+		ID:         attachment.ID,
+		Receiver:   msg.Receiver,
+		Purpose:    msg.Purpose,
+		Attachment: public,
+	})
+}
+
+// avatar возвращает аватар пользователя login, если он виден запрашивающему
+func (t *transfers) avatar(login string) (*handlers.Attachment, error) {
+	login, err := validation.NormalizeLogin(login)
+	if err != nil {
+		return nil, err
+	}
+	t.server.mutex.Lock()
+	defer t.server.mutex.Unlock()
+	target, err := database.GetUserByLogin(t.server.DB, login)
+	if err == sql.ErrNoRows {
+		return nil, database.ErrNoAttachment
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile, err := database.GetProfile(t.server.DB, target.Id)
+	if err != nil {
+		return nil, err
+	}
+	if profile.Avatar == nil {
+		return nil, database.ErrNoAttachment
+	}
+	if target.Id != t.user.Id {
+		blocked, err := database.IsBlockedBy(t.server.DB, t.user.Id, target.Id)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, database.ErrNoAttachment
+		}
+	}
+	return profile.Avatar, nil
+}
+
+// Close удаляет временные файлы незавершенных загрузок
+func (t *transfers) Close() {
+	for id := range t.uploads {
+		t.abort(id)
+	}
+}
+
+// publicAttachment - копия вложения для клиента, без ключа в хранилище
+func publicAttachment(attachment *handlers.Attachment) *handlers.Attachment {
+	if attachment == nil {
+		return nil
+	}
+	public := *attachment
+	public.Key = ""
+	return &public
+}
+
+func (server *Server) deleteBlob(key string) {
+	err := server.blobs.Delete(context.Background(), key)
+	if err != nil {
+		server.logger.Error("delete blob", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"server/database"
+	"server/handlers"
+	"server/validation"
+)
+
+// typing пересылает событие набора текста получателю напрямую, минуя kafka и базу
+// сообщений; лишние события и события для тех, кто offline, молча отбрасываются
+func (server *Server) typing(user *handlers.User, msg handlers.Msg) {
+	if !server.limits.AllowTyping(user.Login) {
+		server.metrics.Throttled.WithLabelValues("typing").Inc()
+		return
+	}
+	receiver, err := validation.NormalizeLogin(msg.Receiver)
+	if err != nil {
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	peer, err := database.GetUserByLogin(server.DB, receiver)
+	if err != nil || peer.Id == user.Id {
+		return
+	}
+	// кому нельзя писать, тому не видно и набора текста
+	if database.CanMessage(server.DB, user.Id, peer.Id) != nil {
+		return
+	}
+	connection, ok := server.Conns[peer.Id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	connection.Send(handlers.Msg{
+		Type:      handlers.TypeTyping,
+		Sender:    user.Login,
+		Receiver:  peer.Login,
+		Timestamp: now.UnixMilli(),
+		Expires:   now.Add(server.config.TypingTTL).UnixMilli(),
+	})
+}
@@ -0,0 +1,215 @@
+package validation
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// users.login - VARCHAR(50)
+	MaxLoginLength = 50
+	// ограничение по умолчанию на длину сообщения в символах
+	DefaultMaxMessageLength = 4096
+	// message_reactions.emoji - VARCHAR(32); составные эмодзи с модификаторами длиннее одного символа
+	MaxEmojiLength = 32
+	// attachments.name - VARCHAR(255)
+	MaxFileNameLength = 255
+	// длина поискового запроса в символах
+	MaxSearchLength = 200
+	// users.display_name - VARCHAR(64), users.bio - VARCHAR(280)
+	MaxDisplayNameLength = 64
+	MaxBioLength         = 280
+	// причина бана или кика, users.ban_reason - VARCHAR(280)
+	MaxReasonLength = 280
+)
+
+// Error - ошибка проверки с машиночитаемым кодом, который уходит клиенту
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrInvalidUTF8  = &Error{Code: "invalid_utf8", Message: "message is not valid UTF-8"}
+	ErrLoginEmpty   = &Error{Code: "login_empty", Message: "login is empty"}
+	ErrLoginTooLong = &Error{Code: "login_too_long", Message: "login is longer than 50 characters"}
+	ErrLoginCharset = &Error{Code: "login_charset", Message: "login may contain only latin letters and digits"}
+	ErrTextEmpty    = &Error{Code: "text_empty", Message: "message is empty"}
+	ErrTextTooLong  = &Error{Code: "text_too_long", Message: "message is too long"}
+
+	ErrUnknownType = &Error{Code: "unknown_type", Message: "unknown message type"}
+	ErrNoMsgID     = &Error{Code: "no_msg_id", Message: "message id is required"}
+	ErrBadScope    = &Error{Code: "bad_scope", Message: "delete scope must be \"me\" or \"everyone\""}
+	ErrBadEmoji    = &Error{Code: "bad_emoji", Message: "reaction must be a single emoji"}
+
+	ErrFileName         = &Error{Code: "bad_file_name", Message: "file name is empty or too long"}
+	ErrBadAttachment    = &Error{Code: "bad_attachment", Message: "attachment must have a name, a size and a SHA-256 checksum"}
+	ErrAttachmentTooBig = &Error{Code: "attachment_too_large", Message: "file is too large"}
+	ErrTooManyUploads   = &Error{Code: "too_many_uploads", Message: "too many uploads in progress"}
+	ErrNoUpload         = &Error{Code: "no_upload", Message: "unknown upload id"}
+	ErrBadChunk         = &Error{Code: "bad_chunk", Message: "chunk offset or size does not match the upload"}
+	ErrChecksumMismatch = &Error{Code: "checksum_mismatch", Message: "uploaded file does not match its checksum"}
+	ErrIncompleteUpload = &Error{Code: "incomplete_upload", Message: "upload finished before all bytes were received"}
+
+	ErrBadSearchRange = &Error{Code: "bad_search_range", Message: "search range must end after it starts"}
+
+	ErrSelfTarget = &Error{Code: "self_target", Message: "you cannot do this with yourself"}
+	ErrBadPrivacy = &Error{Code: "bad_privacy", Message: "privacy must be \"everyone\", \"contacts\" or \"nobody\""}
+
+	ErrNoProfile          = &Error{Code: "no_profile", Message: "profile is required"}
+	ErrDisplayNameTooLong = &Error{Code: "display_name_too_long", Message: "display name is longer than 64 characters"}
+	ErrBioTooLong         = &Error{Code: "bio_too_long", Message: "status text is longer than 280 characters"}
+	ErrBadTimezone        = &Error{Code: "bad_timezone", Message: "unknown time zone"}
+	ErrNotImage           = &Error{Code: "not_image", Message: "avatar must be an image"}
+
+	ErrNoAccount  = &Error{Code: "no_account", Message: "current password is required"}
+	ErrSameLogin  = &Error{Code: "same_login", Message: "new login is the same as the current one"}
+	ErrNoPassword = &Error{Code: "no_password", Message: "new password is required"}
+
+	ErrBadCommand = &Error{Code: "bad_command", Message: "unknown admin command"}
+	ErrBadRole    = &Error{Code: "bad_role", Message: "role must be \"user\", \"moderator\" or \"admin\""}
+	ErrBadBanTime = &Error{Code: "bad_ban_time", Message: "ban must end in the future"}
+	ErrNoReportID = &Error{Code: "no_report_id", Message: "report id is required"}
+
+	ErrSenderMismatch = &Error{Code: "sender_mismatch", Message: "sender does not match the authenticated user"}
+)
+
+// ValidUTF8 проверяет сырой кадр до разбора JSON, который молча заменяет
+// некорректные последовательности на U+FFFD
+func ValidUTF8(data []byte) error {
+	if !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// NormalizeLogin проверяет логин по тем же правилам, что и клиент
+func NormalizeLogin(login string) (string, error) {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return "", ErrLoginEmpty
+	}
+	if len(login) > MaxLoginLength {
+		return "", ErrLoginTooLong
+	}
+	for _, c := range login {
+		if !(('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')) {
+			return "", ErrLoginCharset
+		}
+	}
+	return login, nil
+}
+
+// NormalizeText приводит текст сообщения к NFC, убирает управляющие символы
+// кроме перевода строки и табуляции и проверяет длину в символах
+func NormalizeText(text string, maxLength int) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", ErrInvalidUTF8
+	}
+	text = norm.NFC.String(text)
+	text = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) && c != '\n' && c != '\t' {
+			return -1
+		}
+		return c
+	}, text)
+	if strings.TrimSpace(text) == "" {
+		return "", ErrTextEmpty
+	}
+	if maxLength > 0 && utf8.RuneCountInString(text) > maxLength {
+		return "", ErrTextTooLong
+	}
+	return text, nil
+}
+
+// NormalizeEmoji проверяет, что реакция состоит только из символов эмодзи
+// с модификаторами и соединителями, а не из произвольного текста
+func NormalizeEmoji(emoji string) (string, error) {
+	if !utf8.ValidString(emoji) {
+		return "", ErrInvalidUTF8
+	}
+	emoji = norm.NFC.String(strings.TrimSpace(emoji))
+	if emoji == "" || utf8.RuneCountInString(emoji) > MaxEmojiLength {
+		return "", ErrBadEmoji
+	}
+	symbols := 0
+	for _, c := range emoji {
+		switch {
+		case unicode.Is(unicode.So, c):
+			symbols++
+		case unicode.In(c, unicode.Sk, unicode.Mn, unicode.Me), c == '\u200d':
+			// модификаторы цвета кожи, селекторы вариантов и соединитель ZWJ
+		default:
+			return "", ErrBadEmoji
+		}
+	}
+	if symbols == 0 {
+		return "", ErrBadEmoji
+	}
+	return emoji, nil
+}
+
+// NormalizeFileName оставляет от имени файла только последний элемент пути
+// без управляющих символов, чтобы получатель не мог сохранить его вне своего каталога
+func NormalizeFileName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidUTF8
+	}
+	name = norm.NFC.String(name)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || utf8.RuneCountInString(name) > MaxFileNameLength {
+		return "", ErrFileName
+	}
+	return name, nil
+}
+
+// NormalizeProfileText приводит поле профиля к NFC и убирает управляющие символы;
+// в отличие от текста сообщения поле может быть пустым и состоит из одной строки
+func NormalizeProfileText(text string, maxLength int, tooLong *Error) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", ErrInvalidUTF8
+	}
+	text = norm.NFC.String(text)
+	text = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, text)
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxLength {
+		return "", tooLong
+	}
+	return text, nil
+}
+
+// ValidTimezone проверяет имя зоны по базе IANA; пустое имя означает "не указана"
+func ValidTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(name) > 64 || name == "Local" {
+		return ErrBadTimezone
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return ErrBadTimezone
+	}
+	return nil
+}